@@ -174,6 +174,8 @@ func (a *ANSIWriterCtx) ioloopEscSeq(w *bufio.Writer, r rune, argptr *[]string)
 			break
 		}
 		kernel.SetConsoleTextAttribute(stdout, uintptr(color))
+	case 'h', 'l': // set or reset a mode, e.g. autowrap
+	case 'n': // report the cursor position, not supported
 	case '\007': // set title
 	case ';':
 		if len(arg) == 0 || arg[len(arg)-1] != "" {
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"unicode"
 )
 
 type AutoCompleter interface {
@@ -33,6 +34,31 @@ type AutoCompleterWithCandidates interface {
 	Complete(line []rune, pos int) []Candidate
 }
 
+// CandidateAggregator may be implemented by an AutoCompleter to replace the
+// common prefix insertion with a domain-specific merge of the candidates,
+// e.g. a path completer merging to the common directory.
+//
+// If ok is false, the candidates are shown for selection.
+type CandidateAggregator interface {
+	AggregateCandidates(cs []Candidate) (c Candidate, ok bool)
+}
+
+// AggregateSuppressor may be implemented by an AutoCompleter to show the
+// candidates for selection even if they could be merged, e.g. when their
+// common prefix is a coincidence. It's asked after each completion.
+type AggregateSuppressor interface {
+	SuppressAggregate() bool
+}
+
+// StreamingCompleter may be implemented by an AutoCompleter whose candidates
+// arrive over time, e.g. from a streaming RPC. They are shown as they come,
+// until the channel is closed. As the whole set isn't known beforehand, the
+// candidates are never merged nor inserted right away: the user picks one
+// with CompleteKey. The channel is drained if the completion ends first.
+type StreamingCompleter interface {
+	CompleteStream(line []rune, pos int) <-chan Candidate
+}
+
 type completerAdapter struct {
 	AutoCompleter
 }
@@ -42,10 +68,16 @@ func (c *completerAdapter) Complete(line []rune, pos int) (cs []Candidate) {
 	if len(lines) == 0 {
 		return nil
 	}
+	// the completer may claim more shared characters than there are
+	// before the cursor, e.g. when completing at the start of the line
+	start := pos - length
+	if start < 0 {
+		start = 0
+	}
 	for _, l := range lines {
 		c := Candidate{
-			NewLine: append(append(line[:pos], l...), line[pos:]...),
-			Display: append(line[pos-length:pos], l...),
+			NewLine: append(append(runes.Copy(line[:pos]), l...), line[pos:]...),
+			Display: append(runes.Copy(line[start:pos]), l...),
 		}
 		cs = append(cs, c)
 	}
@@ -61,6 +93,47 @@ func (t *TabCompleter) Do([]rune, int) ([][]rune, int) {
 type Candidate struct {
 	NewLine []rune
 	Display []rune
+	// if set, NewLine only replaces the runes of the line from ReplaceStart
+	// to ReplaceEnd (e.g. the word around the cursor) and the cursor moves
+	// after it, [0, 0) means unset
+	ReplaceStart, ReplaceEnd int
+	// computes the Display when it's not set, it's only called once the
+	// candidate is shown, e.g. for a Display costly to build
+	DisplayFunc func() []rune
+	// shown before the Display in the grid, e.g. an icon for the type
+	// of the candidate
+	Prefix []rune
+	// shown next to the Display, candidates with a description are
+	// listed one per line
+	Description []rune
+	// candidates of the same group are shown together under a header
+	// with the group name, the group of a candidate should be the same
+	// as the previous one to be put in the same section
+	Group string
+	// the NewLine holds placeholders, ${1:default}, ${1} or $1, written
+	// as their default text. The cursor goes to the end of the first one
+	// and CompleteKey moves it to the next ones, $0 (or the end of the
+	// snippet) being the last.
+	Snippet bool
+}
+
+// CompletionRenderer draws the completion candidates in place of the
+// built-in grid, e.g. in a menu of a GUI. The selection and the keys are
+// still handled by readline.
+type CompletionRenderer interface {
+	// Render is called whenever the candidates or the selection change,
+	// selected is -1 if no candidate is selected. It's called with no
+	// candidates once the completion ends.
+	Render(candidates []Candidate, selected int, width int)
+}
+
+// candidateGroup is a section of the candidate grid.
+type candidateGroup struct {
+	name   string
+	start  int // index of the first candidate of the group
+	size   int
+	row    int // grid row of the first candidate, the header is above it
+	rowNum int
 }
 
 type opCompleter struct {
@@ -74,6 +147,14 @@ type opCompleter struct {
 	candidateSource []rune
 	candidateChoise int
 	candidateColNum int
+	candidateGroups []candidateGroup
+
+	// where the grid was drawn, to map the mouse clicks to the candidates:
+	// the lines between the cursor and the grid, the row drawn on each
+	// line of the grid (-1 for the others) and the width of the cells
+	gridOffset    int
+	gridRows      []int
+	gridCellWidth int
 }
 
 func newOpCompleter(w io.Writer, op *Operation, width int) *opCompleter {
@@ -85,9 +166,12 @@ func newOpCompleter(w io.Writer, op *Operation, width int) *opCompleter {
 }
 
 func (o *opCompleter) doSelect() {
+	if len(o.candidate) == 0 {
+		// the candidates are still streamed
+		return
+	}
 	if len(o.candidate) == 1 {
-		o.writeCandidate(o.candidate[0])
-		o.ExitCompleteMode(false)
+		o.acceptCandidate(o.candidate[0])
 		return
 	}
 	o.nextCandidate(1)
@@ -103,7 +187,7 @@ func (o *opCompleter) nextCandidate(i int) {
 }
 
 func (o *opCompleter) OnComplete() bool {
-	if o.width == 0 {
+	if o.width == 0 || o.op.GetConfig().usePlainOutput() {
 		return false
 	}
 	if o.IsInCompleteSelectMode() {
@@ -123,14 +207,13 @@ func (o *opCompleter) OnComplete() bool {
 	o.ExitCompleteSelectMode()
 	o.candidateSource = rs
 
-	var ac AutoCompleterWithCandidates
-	if acc, ok := o.op.cfg.AutoComplete.(AutoCompleterWithCandidates); ok {
-		ac = acc
-	} else {
-		ac = &completerAdapter{o.op.cfg.AutoComplete}
+	if sc, ok := o.op.cfg.AutoComplete.(StreamingCompleter); ok {
+		o.op.stream = sc.CompleteStream(rs, buf.idx)
+		o.EnterCompleteMode(nil)
+		return true
 	}
 
-	newLines := ac.Complete(rs, buf.idx)
+	newLines := o.completer().Complete(rs, buf.idx)
 	if len(newLines) == 0 {
 		o.ExitCompleteMode(false)
 		return true
@@ -138,27 +221,76 @@ func (o *opCompleter) OnComplete() bool {
 
 	// only Aggregate candidates in non-complete mode
 	if !o.IsInCompleteMode() {
-		if len(newLines) == 1 {
-			o.writeCandidate(newLines[0])
-			o.ExitCompleteMode(false)
+		// a candidate with a description is shown to let the user confirm it
+		if len(newLines) == 1 && len(newLines[0].Description) == 0 {
+			o.acceptCandidate(newLines[0])
 			return true
 		}
 
 		if same, ok := o.aggregate(newLines); ok {
 			o.writeCandidate(same)
-			o.ExitCompleteMode(false)
-			return true
+			if !o.op.cfg.MenuOnPrefixComplete {
+				o.ExitCompleteMode(false)
+				return true
+			}
+			// show the candidates left for the extended line right away
+			o.candidateSource = buf.Runes()
+			newLines = o.completer().Complete(o.candidateSource, buf.Pos())
+			if len(newLines) < 2 {
+				o.ExitCompleteMode(false)
+				return true
+			}
 		}
 	}
 
+	if sortFunc := o.op.GetConfig().CompletionSort; sortFunc != nil {
+		newLines = sortFunc(newLines)
+	}
+	ambiguous := !o.IsInCompleteMode() && len(newLines) > 1
 	o.EnterCompleteMode(newLines)
+	if ambiguous && o.op.GetConfig().BellOnAmbiguous {
+		o.op.t.Bell()
+	}
+	return true
+}
+
+func (o *opCompleter) completer() AutoCompleterWithCandidates {
+	if ac, ok := o.op.cfg.AutoComplete.(AutoCompleterWithCandidates); ok {
+		return ac
+	}
+	return &completerAdapter{o.op.cfg.AutoComplete}
+}
+
+// completeUnique writes the candidate if there is only one for the line,
+// and reports whether it did.
+func (o *opCompleter) completeUnique() bool {
+	if o.width == 0 || o.op.GetConfig().usePlainOutput() || o.IsInCompleteMode() {
+		return false
+	}
+	rs := o.op.buf.Runes()
+	cs := o.completer().Complete(rs, o.op.buf.idx)
+	if len(cs) != 1 {
+		return false
+	}
+	o.candidateSource = rs
+	o.writeCandidate(cs[0])
 	return true
 }
 
 func (o *opCompleter) aggregate(cs []Candidate) (Candidate, bool) {
+	if s, ok := o.op.cfg.AutoComplete.(AggregateSuppressor); ok && s.SuppressAggregate() {
+		return Candidate{}, false
+	}
+	if agg, ok := o.op.cfg.AutoComplete.(CandidateAggregator); ok {
+		return agg.AggregateCandidates(cs)
+	}
 	var newLines [][]rune
 	newLines = append(newLines, o.candidateSource)
 	for _, c := range cs {
+		if c.hasReplaceRange() {
+			// the new lines don't share the source as prefix
+			return Candidate{}, false
+		}
 		newLines = append(newLines, c.NewLine)
 	}
 	if same, size := runes.Aggregate(newLines); size > len(o.candidateSource) {
@@ -175,50 +307,74 @@ func (o *opCompleter) IsInCompleteMode() bool {
 	return o.inCompleteMode
 }
 
+// isCompletionAcceptKey reports whether r writes the selected candidate.
+func (o *opCompleter) isCompletionAcceptKey(r rune) bool {
+	if r == CharEnter || r == CharCtrlJ {
+		return true
+	}
+	if _, ok := o.quickSelectIndex(r); ok {
+		return true
+	}
+	for _, k := range o.op.cfg.CompletionAcceptKeys {
+		if r == k {
+			return true
+		}
+	}
+	return false
+}
+
+// quickSelectIndex returns the index of the candidate picked by r with
+// CompletionQuickSelect, the digits 1 to 9 pick the first nine ones.
+func (o *opCompleter) quickSelectIndex(r rune) (int, bool) {
+	if !o.op.cfg.CompletionQuickSelect || r < '1' || r > '9' {
+		return 0, false
+	}
+	return int(r - '1'), true
+}
+
 func (o *opCompleter) HandleCompleteSelect(r rune) bool {
 	next := true
+	if idx, ok := o.quickSelectIndex(r); ok {
+		if idx >= len(o.candidate) {
+			o.op.t.Bell()
+			return true
+		}
+		o.candidateChoise = idx
+	}
+	if o.isCompletionAcceptKey(r) {
+		r = CharEnter
+	}
 	switch r {
-	case CharEnter, CharCtrlJ:
+	case CharEnter:
 		next = false
-		o.writeCandidate(o.op.candidate[o.op.candidateChoise])
-		o.ExitCompleteMode(false)
+		o.acceptCandidate(o.op.candidate[o.op.candidateChoise])
 	case CharLineStart:
-		num := o.candidateChoise % o.candidateColNum
-		o.nextCandidate(-num)
+		row, _ := o.candidateCell(o.candidateChoise)
+		o.candidateChoise = o.candidateIndex(row, 0)
 	case CharLineEnd:
-		num := o.candidateColNum - o.candidateChoise%o.candidateColNum - 1
-		o.candidateChoise += num
-		if o.candidateChoise >= len(o.candidate) {
-			o.candidateChoise = len(o.candidate) - 1
+		row, _ := o.candidateCell(o.candidateChoise)
+		for col := o.candidateColNum - 1; col >= 0; col-- {
+			if idx := o.candidateIndex(row, col); idx >= 0 {
+				o.candidateChoise = idx
+				break
+			}
 		}
 	case CharBackspace:
 		o.ExitCompleteSelectMode()
 		next = false
-	case CharTab, CharForward:
+	case o.op.cfg.CompleteKey:
 		o.doSelect()
 	case CharBell, CharInterrupt:
 		o.ExitCompleteMode(true)
 		next = false
 	case CharNext:
-		tmpChoise := o.candidateChoise + o.candidateColNum
-		if tmpChoise >= o.getMatrixSize() {
-			tmpChoise -= o.getMatrixSize()
-		} else if tmpChoise >= len(o.candidate) {
-			tmpChoise += o.candidateColNum
-			tmpChoise -= o.getMatrixSize()
-		}
-		o.candidateChoise = tmpChoise
+		o.moveVertical(1)
+	case CharForward:
+		o.moveHorizontal(1)
 	case CharBackward:
-		o.nextCandidate(-1)
+		o.moveHorizontal(-1)
 	case CharPrev:
-		tmpChoise := o.candidateChoise - o.candidateColNum
-		if tmpChoise < 0 {
-			tmpChoise += o.getMatrixSize()
-			if tmpChoise >= len(o.candidate) {
-				tmpChoise -= o.candidateColNum
-			}
-		}
-		o.candidateChoise = tmpChoise
+		o.moveVertical(-1)
 	default:
 		next = false
 		o.ExitCompleteSelectMode()
@@ -230,82 +386,457 @@ func (o *opCompleter) HandleCompleteSelect(r rune) bool {
 	return false
 }
 
+func (c Candidate) hasReplaceRange() bool {
+	return c.ReplaceStart != 0 || c.ReplaceEnd != 0
+}
+
+// acceptCandidate writes c and leaves the completion, which starts again
+// for the new line if ReopenCompletionAfterAccept says so.
+func (o *opCompleter) acceptCandidate(c Candidate) {
+	before := o.op.buf.Runes()
+	o.writeCandidate(c)
+	o.ExitCompleteMode(false)
+	reopen := o.op.cfg.ReopenCompletionAfterAccept
+	// the line must change not to reopen it forever
+	if reopen != nil && !runes.Equal(before, o.op.buf.Runes()) && reopen(c) {
+		o.OnComplete()
+	}
+}
+
+// applyCandidate accepts c as a candidate for the line, which is its
+// source unless the candidates are shown already.
+func (o *opCompleter) applyCandidate(c Candidate) {
+	if !o.IsInCompleteMode() {
+		o.candidateSource = o.op.buf.Runes()
+	}
+	o.acceptCandidate(c)
+}
+
 func (o *opCompleter) writeCandidate(c Candidate) {
-	if runes.HasPrefix(c.NewLine, o.candidateSource) {
-		o.op.buf.WriteRunes(c.NewLine[len(o.candidateSource):])
-	} else {
-		o.op.buf.Backspaces(len(o.candidateSource))
-		o.op.buf.WriteRunes(c.NewLine)
+	var stops []snippetTabstop
+	if c.Snippet {
+		c.NewLine, stops = parseSnippet(c.NewLine)
+	}
+	start, end, from, to := o.candidateRange(c)
+	o.op.buf.ReplaceRange(start, end, c.NewLine[from:to])
+	if len(stops) > 0 {
+		o.op.EnterSnippetMode(stops, start-from)
 	}
 }
 
+// candidateRange returns the runes of the line from start to end which c
+// rewrites with its NewLine from `from` to `to`. Unless c has a replace
+// range, the NewLine is the whole line: the parts it shares with the source
+// before the cursor and at the end of the line are kept, the candidate may
+// be shorter than the source (e.g. a normalized path) and the line after
+// the cursor stays as it is.
+func (o *opCompleter) candidateRange(c Candidate) (start, end, from, to int) {
+	line, idx := o.op.buf.Runes(), o.op.buf.Pos()
+	if c.hasReplaceRange() {
+		start, end = c.ReplaceStart, c.ReplaceEnd
+		if end > len(line) {
+			end = len(line)
+		}
+		if start < 0 {
+			start = 0
+		} else if start > end {
+			start = end
+		}
+		return start, end, 0, len(c.NewLine)
+	}
+	source := o.candidateSource
+	if idx > len(source) {
+		idx = len(source)
+	}
+	same := runes.PrefixLen(c.NewLine, source)
+	if same > idx {
+		same = idx
+	}
+	tail := 0
+	for tail < len(source)-idx && tail < len(c.NewLine)-same &&
+		c.NewLine[len(c.NewLine)-1-tail] == source[len(source)-1-tail] {
+		tail++
+	}
+	return same, len(source) - tail, same, len(c.NewLine) - tail
+}
+
+// candidateLine returns the line as writeCandidate would leave it.
+func (o *opCompleter) candidateLine(c Candidate) []rune {
+	line := o.op.buf.Runes()
+	start, end, from, to := o.candidateRange(c)
+	if end > len(line) {
+		end = len(line)
+	}
+	if start > end {
+		start = end
+	}
+	return append(append(line[:start:start], c.NewLine[from:to]...), line[end:]...)
+}
+
 func (o *opCompleter) getMatrixSize() int {
-	line := len(o.candidate) / o.candidateColNum
-	if len(o.candidate)%o.candidateColNum != 0 {
-		line++
+	return o.candidateRowNum() * o.candidateColNum
+}
+
+func (o *opCompleter) candidateRowNum() int {
+	if len(o.candidateGroups) == 0 {
+		return 0
+	}
+	last := o.candidateGroups[len(o.candidateGroups)-1]
+	return last.row + last.rowNum
+}
+
+// layoutGroups splits the candidates into sections by their group,
+// it must be called whenever the candidates or the column number change.
+func (o *opCompleter) layoutGroups() {
+	o.candidateGroups = o.candidateGroups[:0]
+	row := 0
+	for start := 0; start < len(o.candidate); {
+		g := candidateGroup{name: o.candidate[start].Group, start: start}
+		for start < len(o.candidate) && o.candidate[start].Group == g.name {
+			start++
+		}
+		g.size = start - g.start
+		g.rowNum = g.size / o.candidateColNum
+		if g.size%o.candidateColNum != 0 {
+			g.rowNum++
+		}
+		if g.name != "" {
+			// header line
+			row++
+		}
+		g.row = row
+		row += g.rowNum
+		o.candidateGroups = append(o.candidateGroups, g)
+	}
+}
+
+// candidateIndex returns the index of the candidate displayed at the given
+// cell of the grid, or -1 if the cell is empty or is a group header.
+func (o *opCompleter) candidateIndex(row, col int) int {
+	if col < 0 || col >= o.candidateColNum {
+		return -1
+	}
+	for _, g := range o.candidateGroups {
+		if row < g.row || row >= g.row+g.rowNum {
+			continue
+		}
+		idx := (row-g.row)*o.candidateColNum + col
+		if o.op.cfg.CompletionColumnMajor {
+			idx = col*g.rowNum + row - g.row
+		}
+		if idx >= g.size {
+			return -1
+		}
+		return g.start + idx
+	}
+	return -1
+}
+
+// candidateCell is the reverse of candidateIndex.
+func (o *opCompleter) candidateCell(idx int) (row, col int) {
+	for _, g := range o.candidateGroups {
+		if idx >= g.start+g.size {
+			continue
+		}
+		idx -= g.start
+		if o.op.cfg.CompletionColumnMajor {
+			return g.row + idx%g.rowNum, idx / g.rowNum
+		}
+		return g.row + idx/o.candidateColNum, idx % o.candidateColNum
+	}
+	return -1, -1
+}
+
+// moveVertical moves the selection up or down within its column,
+// wrapping around at the top and bottom.
+func (o *opCompleter) moveVertical(step int) {
+	rowNum := o.candidateRowNum()
+	row, col := o.candidateCell(o.candidateChoise)
+	for i := 0; i < rowNum; i++ {
+		row = (row + step + rowNum) % rowNum
+		if idx := o.candidateIndex(row, col); idx >= 0 {
+			o.candidateChoise = idx
+			return
+		}
+	}
+}
+
+// moveHorizontal moves the selection left or right in reading order,
+// continuing on the previous/next row when reaching the edge of the grid.
+func (o *opCompleter) moveHorizontal(step int) {
+	size := o.getMatrixSize()
+	row, col := o.candidateCell(o.candidateChoise)
+	cell := row*o.candidateColNum + col
+	for i := 0; i < size; i++ {
+		cell = (cell + step + size) % size
+		if idx := o.candidateIndex(cell/o.candidateColNum, cell%o.candidateColNum); idx >= 0 {
+			o.candidateChoise = idx
+			return
+		}
 	}
-	return line * o.candidateColNum
 }
 
 func (o *opCompleter) OnWidthChange(newWidth int) {
 	o.width = newWidth
 }
 
+// candidateDisplay returns the Display of c, shortened to the configured
+// maximum width, with typed in bold if it starts with it (regardless of
+// case with CompletionIgnoreCase).
+func (o *opCompleter) candidateDisplay(c Candidate, typed []rune) []rune {
+	display := c.Display
+	if max := o.op.cfg.CompletionMaxDisplayWidth; max > 0 {
+		display = truncate(display, max, o.op.cfg.runeWidth)
+	}
+	if len(typed) > 0 && o.hasTypedPrefix(display, typed) {
+		display = append(append(append([]rune("\033[1m"), display[:len(typed)]...),
+			[]rune("\033[22m")...), display[len(typed):]...)
+	}
+	if len(c.Prefix) > 0 {
+		display = append(runes.Copy(c.Prefix), display...)
+	}
+	return display
+}
+
+// loadDisplays sets the Display of the candidates built by a DisplayFunc,
+// which is called only once.
+func (o *opCompleter) loadDisplays() {
+	for i, c := range o.candidate {
+		if c.Display == nil && c.DisplayFunc != nil {
+			o.candidate[i].Display = c.DisplayFunc()
+			o.candidate[i].DisplayFunc = nil
+		}
+	}
+}
+
+// shownCandidates returns the candidates as they're shown, transformed by
+// CompletionDisplayTransform.
+func (o *opCompleter) shownCandidates() []Candidate {
+	transform := o.op.cfg.CompletionDisplayTransform
+	if transform == nil {
+		return o.candidate
+	}
+	cs := make([]Candidate, len(o.candidate))
+	copy(cs, o.candidate)
+	if cs = transform(cs); len(cs) != len(o.candidate) {
+		// they must match the candidates one by one
+		return o.candidate
+	}
+	return cs
+}
+
+func (o *opCompleter) hasTypedPrefix(display, typed []rune) bool {
+	if !o.op.cfg.CompletionIgnoreCase {
+		return runes.HasPrefix(display, typed)
+	}
+	return len(display) >= len(typed) && runes.EqualFold(display[:len(typed)], typed)
+}
+
+// typedWord returns the word typed before the cursor if the part of the
+// candidates matching it should be highlighted.
+func (o *opCompleter) typedWord() []rune {
+	if !o.op.cfg.CompletionHighlightTyped {
+		return nil
+	}
+	line, pos := o.op.buf.Runes(), o.op.buf.Pos()
+	start := pos
+	for start > 0 && !unicode.IsSpace(line[start-1]) {
+		start--
+	}
+	return line[start:pos]
+}
+
+// displayWidth returns the screen width of rs, ignoring the color sequences.
+func (o *opCompleter) displayWidth(rs []rune) int {
+	return o.op.cfg.widthAll(runes.ColorFilter(rs))
+}
+
 func (o *opCompleter) CompleteRefresh() {
 	if !o.inCompleteMode {
 		return
 	}
+	o.loadDisplays()
+	shown := o.shownCandidates()
+	if r := o.op.cfg.CompletionRenderer; r != nil {
+		// navigate the candidates as a list
+		o.gridRows = nil
+		o.candidateColNum = 1
+		o.layoutGroups()
+		selected := -1
+		if o.IsInCompleteSelectMode() {
+			selected = o.candidateChoise
+		}
+		r.Render(shown, selected, o.width)
+		return
+	}
 	lineCnt := o.op.buf.CursorLineCount()
+	typed := o.typedWord()
 	colWidth := 0
-	for _, c := range o.candidate {
-		w := runes.WidthAll(c.Display)
+	descWidth := 0
+	hasDescription := false
+	for _, c := range shown {
+		w := o.displayWidth(o.candidateDisplay(c, typed))
 		if w > colWidth {
 			colWidth = w
 		}
+		if len(c.Description) > 0 {
+			hasDescription = true
+			if w := o.displayWidth(c.Description); w > descWidth {
+				descWidth = w
+			}
+		}
 	}
 
-	colWidth += 1
+	// the columns are followed by a space, unless they're separated
+	sep := o.op.cfg.CompletionColumnSep
+	sepWidth := o.displayWidth([]rune(sep))
+	descSep := sep
+	if sep == "" {
+		colWidth += 1
+		descSep = " "
+	}
 
 	// -1 to avoid reach the end of line
 	width := o.width - 1
-	colNum := width / colWidth
-	if colNum != 0 {
+	colNum := 0
+	if colWidth+sepWidth > 0 {
+		colNum = (width + sepWidth) / (colWidth + sepWidth)
+	}
+	if colNum < 1 || hasDescription {
+		// the candidates are wider than the screen, have descriptions or
+		// take no room at all, show one per line
+		colNum = 1
+	}
+	if max := o.op.cfg.CompletionMaxColumns; max > 0 && colNum > max {
+		colNum = max
+	} else if colNum > 1 && sep == "" {
 		colWidth += (width - (colWidth * colNum)) / colNum
 	}
 
+	// the descriptions are cut to the room left after the candidates
+	descRoom := width - colWidth - o.displayWidth([]rune(descSep))
+
 	o.candidateColNum = colNum
+	o.layoutGroups()
 	buf := bufio.NewWriter(o.w)
 	buf.Write(bytes.Repeat([]byte("\n"), lineCnt))
 
-	colIdx := 0
-	lines := 1
+	lines := 0
+	o.gridOffset, o.gridRows, o.gridCellWidth = lineCnt, nil, colWidth+sepWidth
+	addRows := func(row, n int) {
+		lines += n
+		for i := 0; i < n; i++ {
+			o.gridRows = append(o.gridRows, row)
+		}
+	}
 	buf.WriteString("\033[J")
-	for idx, c := range o.candidate {
-		inSelect := idx == o.candidateChoise && o.IsInCompleteSelectMode()
-		if inSelect {
-			buf.WriteString("\033[30;47m")
+	noAutowrap := o.op.cfg.gridNoAutowrap
+	if noAutowrap {
+		// a full-width row doesn't move the cursor to the next line
+		buf.WriteString("\033[?7l")
+	}
+	newLine := func() {
+		if lines > 0 {
+			buf.WriteString("\n")
 		}
-		buf.WriteString(string(c.Display))
-		buf.Write(bytes.Repeat([]byte(" "), colWidth-runes.WidthAll(c.Display)))
-
-		if inSelect {
-			buf.WriteString("\033[0m")
+	}
+	for _, g := range o.candidateGroups {
+		if g.name != "" {
+			newLine()
+			buf.WriteString("\033[2m" + g.name + "\033[0m")
+			addRows(-1, 1)
 		}
-
-		colIdx++
-		if colIdx == colNum {
-			buf.WriteString("\n")
-			lines++
-			colIdx = 0
+		for row := g.row; row < g.row+g.rowNum; row++ {
+			newLine()
+			// a candidate wider than the screen wraps to the next lines
+			rowWidth := 0
+			for col := 0; col < colNum; col++ {
+				idx := o.candidateIndex(row, col)
+				if idx < 0 {
+					break
+				}
+				c := shown[idx]
+				if col > 0 {
+					buf.WriteString(sep)
+					rowWidth += sepWidth
+				}
+				inSelect := idx == o.candidateChoise && o.IsInCompleteSelectMode()
+				if inSelect {
+					buf.WriteString("\033[30;47m")
+				}
+				display := o.candidateDisplay(c, typed)
+				buf.WriteString(string(display))
+				rowWidth += o.displayWidth(display)
+				if pad := colWidth - o.displayWidth(display); pad > 0 {
+					buf.Write(bytes.Repeat([]byte(" "), pad))
+					rowWidth += pad
+				}
+
+				if inSelect {
+					buf.WriteString("\033[0m")
+				}
+				if len(c.Description) > 0 {
+					desc := c.Description
+					if descRoom > 0 && descWidth > descRoom {
+						desc = truncate(desc, descRoom, o.op.cfg.runeWidth)
+					}
+					buf.WriteString(descSep + string(desc))
+					rowWidth += o.displayWidth([]rune(descSep)) + o.displayWidth(desc)
+				}
+			}
+			if rowWidth > o.width && !noAutowrap {
+				addRows(row, LineCount(o.width, rowWidth))
+			} else {
+				addRows(row, 1)
+			}
 		}
 	}
+	if o.op.cfg.ShowCompletionPreview && o.IsInCompleteSelectMode() &&
+		o.candidateChoise >= 0 && o.candidateChoise < len(o.candidate) {
+		preview := o.candidateLine(o.candidate[o.candidateChoise])
+		newLine()
+		buf.WriteString("\033[2m" + string(preview) + "\033[0m")
+		if w := o.op.cfg.widthAll(preview); w > o.width && !noAutowrap {
+			addRows(-1, LineCount(o.width, w))
+		} else {
+			addRows(-1, 1)
+		}
+	}
+	if noAutowrap {
+		buf.WriteString("\033[?7h")
+	}
 
 	// move back
 	fmt.Fprintf(buf, "\033[%dA\r", lineCnt-1+lines)
 	fmt.Fprintf(buf, "\033[%dC", o.op.buf.idx+o.op.buf.PromptLen())
+	if o.op.cfg.EnableMouse {
+		// ask for the cursor row, the grid is below it
+		buf.WriteString("\033[6n")
+	}
 	buf.Flush()
 }
 
+// HandleClick writes the candidate drawn at the screen cell clicked (with
+// 1-based coordinates) and leaves the completion, it reports whether there
+// was one.
+func (o *opCompleter) HandleClick(col, row int) bool {
+	cursorRow := o.op.t.reportedCursorRow()
+	if !o.inCompleteMode || cursorRow <= 0 || o.gridCellWidth <= 0 {
+		return false
+	}
+	line := row - cursorRow - o.gridOffset
+	if line < 0 || line >= len(o.gridRows) || o.gridRows[line] < 0 {
+		return false
+	}
+	idx := o.candidateIndex(o.gridRows[line], (col-1)/o.gridCellWidth)
+	if idx < 0 {
+		return false
+	}
+	o.candidateChoise = idx
+	o.acceptCandidate(o.candidate[idx])
+	return true
+}
+
 func (o *opCompleter) aggCandidate(candidate [][]rune) int {
 	offset := 0
 	for i := 0; i < len(candidate[0]); i++ {
@@ -330,12 +861,33 @@ func (o *opCompleter) EnterCompleteSelectMode() {
 }
 
 func (o *opCompleter) EnterCompleteMode(candidates []Candidate) {
+	if !o.inCompleteMode {
+		o.notifyCompleteMode(true)
+	}
 	o.inCompleteMode = true
 	o.candidate = candidates
 	o.CompleteRefresh()
 }
 
+// onStream adds the candidate received from the stream, ok is false once
+// it's closed.
+func (o *opCompleter) onStream(c Candidate, ok bool) {
+	if !ok || !o.inCompleteMode {
+		o.op.stream = nil
+		return
+	}
+	o.candidate = append(o.candidate, c)
+	o.CompleteRefresh()
+}
+
 func (o *opCompleter) ExitCompleteSelectMode() {
+	if o.op.stream != nil {
+		go func(stream <-chan Candidate) {
+			for range stream {
+			}
+		}(o.op.stream)
+		o.op.stream = nil
+	}
 	o.inSelectMode = false
 	o.candidate = nil
 	o.candidateChoise = -1
@@ -343,6 +895,19 @@ func (o *opCompleter) ExitCompleteSelectMode() {
 }
 
 func (o *opCompleter) ExitCompleteMode(revent bool) {
+	if r := o.op.cfg.CompletionRenderer; r != nil && o.inCompleteMode {
+		r.Render(nil, -1, o.width)
+	}
+	active := o.inCompleteMode
 	o.inCompleteMode = false
 	o.ExitCompleteSelectMode()
+	if active {
+		o.notifyCompleteMode(false)
+	}
+}
+
+func (o *opCompleter) notifyCompleteMode(active bool) {
+	if f := o.op.cfg.OnCompleteModeChange; f != nil {
+		f(active)
+	}
 }
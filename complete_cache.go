@@ -0,0 +1,82 @@
+package readline
+
+import "sync"
+
+// CachingCompleter memoizes the results of an expensive AutoCompleter.
+//
+// The results are kept for the word being completed: pressing Tab again, or
+// typing more characters of the same word, filters the cached candidates
+// instead of querying the AutoCompleter. The cache is dropped as soon as the
+// rest of the line changes or a space is typed, and can be dropped manually
+// with Invalidate.
+type CachingCompleter struct {
+	AutoCompleter
+
+	m     sync.Mutex
+	valid bool
+	head  []rune   // the line before the word being completed
+	tail  []rune   // the line after the cursor
+	typed []rune   // the part of the word typed when querying
+	words [][]rune // the complete candidate words
+}
+
+func NewCachingCompleter(c AutoCompleter) *CachingCompleter {
+	return &CachingCompleter{AutoCompleter: c}
+}
+
+// Invalidate drops the cached candidates, e.g. when the data they were built
+// from has changed.
+func (c *CachingCompleter) Invalidate() {
+	c.m.Lock()
+	c.valid = false
+	c.m.Unlock()
+}
+
+func (c *CachingCompleter) Do(line []rune, pos int) (newLine [][]rune, length int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if word, ok := c.cachedWord(line, pos); ok {
+		for _, w := range c.words {
+			if runes.HasPrefix(w, word) {
+				newLine = append(newLine, runes.Copy(w[len(word):]))
+			}
+		}
+		return newLine, len(word)
+	}
+
+	newLine, length = c.AutoCompleter.Do(line, pos)
+	// as in completerAdapter, the length may not fit before the cursor
+	start := pos - length
+	if start < 0 {
+		start = 0
+	} else if start > pos {
+		start = pos
+	}
+	c.valid = true
+	c.head = runes.Copy(line[:start])
+	c.tail = runes.Copy(line[pos:])
+	c.typed = runes.Copy(line[start:pos])
+	c.words = make([][]rune, 0, len(newLine))
+	for _, l := range newLine {
+		c.words = append(c.words, append(runes.Copy(c.typed), l...))
+	}
+	return newLine, length
+}
+
+// cachedWord returns the word being completed if the cached candidates
+// can be used for completing it.
+func (c *CachingCompleter) cachedWord(line []rune, pos int) ([]rune, bool) {
+	start := len(c.head)
+	if !c.valid || pos < start || pos > len(line) {
+		return nil, false
+	}
+	if !runes.Equal(line[:start], c.head) || !runes.Equal(line[pos:], c.tail) {
+		return nil, false
+	}
+	word := line[start:pos]
+	if !runes.HasPrefix(word, c.typed) || runes.Index(' ', word[len(c.typed):]) >= 0 {
+		return nil, false
+	}
+	return word, true
+}
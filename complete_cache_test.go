@@ -0,0 +1,73 @@
+package readline
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/chzyer/test"
+)
+
+type countingCompleter struct {
+	AutoCompleter
+	calls int
+}
+
+func (c *countingCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	c.calls++
+	return c.AutoCompleter.Do(line, pos)
+}
+
+func TestCachingCompleter(t *testing.T) {
+	defer test.New(t)
+
+	counter := &countingCompleter{AutoCompleter: NewPrefixCompleter(
+		PcItem("git", PcItem("checkout"), PcItem("cherry-pick")),
+		PcItem("go"),
+		PcItem("grep"),
+	)}
+	c := NewCachingCompleter(counter)
+
+	ret := []struct {
+		Line  string
+		Ret   []string
+		Share int
+		Calls int
+	}{
+		{"g", []string{"it ", "o ", "rep "}, 1, 1},
+		// same line again, e.g. pressing Tab twice
+		{"g", []string{"it ", "o ", "rep "}, 1, 1},
+		// typing more of the same word filters the cached candidates
+		{"gi", []string{"t "}, 2, 1},
+		{"gr", []string{"ep "}, 2, 1},
+		// a new word is a new query
+		{"git ch", []string{"eckout ", "erry-pick "}, 2, 2},
+		{"git che", []string{"ckout ", "rry-pick "}, 3, 2},
+		{"git c", []string{"heckout ", "herry-pick "}, 1, 3},
+	}
+	for i, r := range ret {
+		line := []rune(r.Line)
+		newLine, length := c.Do(line, len(line))
+		test.Equal(rs(newLine), r.Ret, fmt.Errorf("%v", i))
+		test.Equal(length, r.Share, fmt.Errorf("%v", i))
+		test.Equal(counter.calls, r.Calls, fmt.Errorf("%v", i))
+	}
+
+	c.Invalidate()
+	c.Do([]rune("git c"), 5)
+	test.Equal(counter.calls, 4)
+}
+
+func TestCachingCompleterLongLength(t *testing.T) {
+	defer test.New(t)
+
+	// the completer claims more shared characters than the cursor has
+	c := NewCachingCompleter(&fixedCompleter{[][]rune{[]rune("lp")}, 4})
+	newLine, length := c.Do([]rune("he"), 2)
+	test.Equal(rs(newLine), []string{"lp"})
+	test.Equal(length, 4)
+
+	// the cached word is what there is before the cursor
+	newLine, length = c.Do([]rune("hel"), 3)
+	test.Equal(rs(newLine), []string{"p"})
+	test.Equal(length, 3)
+}
@@ -0,0 +1,78 @@
+package readline
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvCompleter completes the names of the environment variables after a
+// `$` or a `${`, e.g. "$HO" to "$HOME" and "${HO" to "${HOME}". See
+// NewEnvCompleter.
+type EnvCompleter struct {
+	// returns the environment as os.Environ does, replaced in the tests
+	environ func() []string
+}
+
+// NewEnvCompleter returns a completer of the variables of os.Environ, it
+// offers nothing unless the word before the cursor starts with `$`. It
+// may be combined with another completer, e.g. one of the commands.
+func NewEnvCompleter() *EnvCompleter {
+	return &EnvCompleter{environ: os.Environ}
+}
+
+func (e *EnvCompleter) Complete(line []rune, pos int) []Candidate {
+	start := pos
+	for start > 0 && line[start-1] != ' ' && line[start-1] != '\t' && line[start-1] != '$' {
+		start--
+	}
+	if start == 0 || line[start-1] != '$' {
+		return nil
+	}
+	start--
+	prefix, open, closing := string(line[start+1:pos]), "$", ""
+	if strings.HasPrefix(prefix, "{") {
+		prefix, open, closing = prefix[1:], "${", "}"
+	}
+	if !isEnvName(prefix) {
+		return nil
+	}
+
+	var names []string
+	for _, kv := range e.environ() {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if name != "" && strings.HasPrefix(name, prefix) && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var cs []Candidate
+	for _, name := range names {
+		newLine := append(runes.Copy(line[:start]), []rune(open+name+closing)...)
+		cs = append(cs, Candidate{
+			NewLine: append(newLine, line[pos:]...),
+			Display: []rune(open + name + closing),
+		})
+	}
+	return cs
+}
+
+// isEnvName reports whether s may start the name of a variable.
+func isEnvName(s string) bool {
+	for _, r := range s {
+		if r != '_' && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Do returns nothing, Readline only asks Complete for the candidates of an
+// AutoCompleterWithCandidates.
+func (e *EnvCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	return nil, 0
+}
@@ -0,0 +1,45 @@
+package readline
+
+import (
+	"testing"
+)
+
+func TestEnvCompleter(t *testing.T) {
+	c := &EnvCompleter{environ: func() []string {
+		return []string{"HOME=/root", "PATH=/bin", "PAGER=less", "EMPTY="}
+	}}
+
+	ret := []struct {
+		line     string
+		pos      int
+		expected string
+	}{
+		{"echo $HO", -1, "echo $HOME=$HOME"},
+		{"echo ${HO", -1, "echo ${HOME}=${HOME}"},
+		{"$PA", -1, "$PAGER=$PAGER,$PATH=$PATH"},
+		{"echo $HO/bin", 8, "echo $HOME/bin=$HOME"},
+		{"${", -1, "${EMPTY}=${EMPTY},${HOME}=${HOME},${PAGER}=${PAGER},${PATH}=${PATH}"},
+		{"echo HO", -1, ""},
+		{"echo $H-", -1, ""},
+	}
+	for _, r := range ret {
+		line := []rune(r.line)
+		pos := r.pos
+		if pos < 0 {
+			pos = len(line)
+		}
+		if got := candidateLines(c.Complete(line, pos)); got != r.expected {
+			t.Fatalf("%q: unexpected candidates %q", r.line, got)
+		}
+	}
+}
+
+func TestEnvCompleterInstance(t *testing.T) {
+	c := NewEnvCompleter()
+	c.environ = func() []string { return []string{"HOME=/root", "PATH=/bin"} }
+	rl, w := newTestInstance(t, &Config{AutoComplete: c})
+	go w.Write([]byte("cd $HO\t\r"))
+	expectLine(t, rl, "cd $HOME")
+	go w.Write([]byte("cd ${HO\t/x\r"))
+	expectLine(t, rl, "cd ${HOME}/x")
+}
@@ -0,0 +1,80 @@
+package readline
+
+// ExtraCandidatesCompleter offers a constant set of candidates, e.g.
+// meta-commands like "help" or "exit", along with those of another
+// completer. See WithExtraCandidates.
+type ExtraCandidatesCompleter struct {
+	base  AutoCompleterWithCandidates
+	extra []Candidate
+}
+
+// WithExtraCandidates returns a completer adding to the candidates of base
+// the extra ones starting with the word before the cursor. The NewLine of
+// an extra candidate is the word replacing it, and its Display defaults to
+// that word.
+func WithExtraCandidates(base AutoCompleterWithCandidates, extra []Candidate) *ExtraCandidatesCompleter {
+	return &ExtraCandidatesCompleter{base: base, extra: extra}
+}
+
+func (c *ExtraCandidatesCompleter) Complete(line []rune, pos int) []Candidate {
+	cs := c.base.Complete(line, pos)
+	start := pos
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	word := line[start:pos]
+	for _, e := range c.extra {
+		if !runes.HasPrefix(e.NewLine, word) {
+			continue
+		}
+		if len(e.Display) == 0 {
+			e.Display = e.NewLine
+		}
+		e.NewLine = append(append(runes.Copy(line[:start]), e.NewLine...), line[pos:]...)
+		cs = append(cs, e)
+	}
+	return cs
+}
+
+// Do is only there to satisfy AutoCompleter, Complete is used instead.
+func (c *ExtraCandidatesCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	if ac, ok := c.base.(AutoCompleter); ok {
+		return ac.Do(line, pos)
+	}
+	return nil, 0
+}
+
+// UniqueCandidatesCompleter drops the candidates of another completer which
+// would give the same line as one before them. See DedupCompleter.
+type UniqueCandidatesCompleter struct {
+	base AutoCompleterWithCandidates
+}
+
+// DedupCompleter returns a completer offering the candidates of base but
+// the ones with the NewLine of a previous candidate, e.g. when base chains
+// completers which know the same words.
+func DedupCompleter(base AutoCompleterWithCandidates) *UniqueCandidatesCompleter {
+	return &UniqueCandidatesCompleter{base: base}
+}
+
+func (c *UniqueCandidatesCompleter) Complete(line []rune, pos int) []Candidate {
+	cs := c.base.Complete(line, pos)
+	seen := make(map[string]bool, len(cs))
+	unique := make([]Candidate, 0, len(cs))
+	for _, cand := range cs {
+		if seen[string(cand.NewLine)] {
+			continue
+		}
+		seen[string(cand.NewLine)] = true
+		unique = append(unique, cand)
+	}
+	return unique
+}
+
+// Do delegates to base if it can, Complete is what Readline asks.
+func (c *UniqueCandidatesCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	if ac, ok := c.base.(AutoCompleter); ok {
+		return ac.Do(line, pos)
+	}
+	return nil, 0
+}
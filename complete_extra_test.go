@@ -0,0 +1,83 @@
+package readline
+
+import (
+	"strings"
+	"testing"
+)
+
+func candidateLines(cs []Candidate) string {
+	var lines []string
+	for _, c := range cs {
+		lines = append(lines, string(c.NewLine)+"="+string(c.Display))
+	}
+	return strings.Join(lines, ",")
+}
+
+func TestWithExtraCandidates(t *testing.T) {
+	base := &completerAdapter{NewPrefixCompleter(PcItem("hello"), PcItem("world"))}
+	c := WithExtraCandidates(base, []Candidate{
+		{NewLine: []rune("help")},
+		{NewLine: []rune("exit"), Display: []rune("exit (quit)")},
+	})
+
+	ret := []struct {
+		line     string
+		expected string
+	}{
+		{"he", "hello =hello ,help=help"},
+		{"ex", "exit=exit (quit)"},
+		{"wo", "world =world "},
+		{"", "hello =hello ,world =world ,help=help,exit=exit (quit)"},
+	}
+	for _, r := range ret {
+		line := []rune(r.line)
+		if got := candidateLines(c.Complete(line, len(line))); got != r.expected {
+			t.Fatalf("%q: unexpected candidates %q", r.line, got)
+		}
+	}
+
+	// only the word before the cursor is replaced
+	line := []rune("say ex now")
+	if got := candidateLines(c.Complete(line, 6)); got != "say exit now=exit (quit)" {
+		t.Fatalf("unexpected candidates %q", got)
+	}
+}
+
+func TestDedupCompleter(t *testing.T) {
+	base := &completerAdapter{NewPrefixCompleter(PcItem("hello"), PcItem("help"))}
+	c := DedupCompleter(WithExtraCandidates(base, []Candidate{
+		{NewLine: []rune("help "), Display: []rune("help (extra)")},
+		{NewLine: []rune("helm ")},
+		{NewLine: []rune("helm ")},
+	}))
+	if got := candidateLines(c.Complete([]rune("he"), 2)); got != "hello =hello ,help =help ,helm =helm " {
+		t.Fatalf("unexpected candidates %q", got)
+	}
+
+	o, w := newTestCompleter(&Config{AutoComplete: c}, 80)
+	o.op.buf.Set([]rune("he"))
+	o.OnComplete()
+	if got := renderedGrid(w.String()); got[len(got)-1] != "hello help helm" {
+		t.Fatalf("unexpected grid %q", got)
+	}
+}
+
+// cachedCandidates returns the same slice on each call.
+type cachedCandidates []Candidate
+
+func (c cachedCandidates) Complete([]rune, int) []Candidate { return c }
+
+func TestDedupCompleterKeepsBase(t *testing.T) {
+	base := cachedCandidates{
+		{NewLine: []rune("a")}, {NewLine: []rune("a")}, {NewLine: []rune("b")},
+	}
+	c := DedupCompleter(base)
+	for i := 0; i < 2; i++ {
+		if got := candidateLines(c.Complete(nil, 0)); got != "a=,b=" {
+			t.Fatalf("unexpected candidates %q", got)
+		}
+	}
+	if got := candidateLines(base); got != "a=,a=,b=" {
+		t.Fatalf("the base candidates are changed: %q", got)
+	}
+}
@@ -0,0 +1,1109 @@
+package readline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCompleter(cfg *Config, width int) (*opCompleter, *bytes.Buffer) {
+	if cfg.Painter == nil {
+		cfg.Painter = &defaultPainter{}
+	}
+	if cfg.FuncIsTerminal == nil {
+		cfg.FuncIsTerminal = func() bool { return false }
+	}
+	cfg.Stdin = ioutil.NopCloser(bytes.NewReader(nil))
+	cfg.Stdout = ioutil.Discard
+	cfg.Init()
+	w := bytes.NewBuffer(nil)
+	op := &Operation{cfg: cfg}
+	op.buf = NewRuneBuffer(w, "", cfg, width)
+	op.opCompleter = newOpCompleter(w, op, width)
+	return op.opCompleter, w
+}
+
+func testCandidates(names ...string) []Candidate {
+	cs := make([]Candidate, 0, len(names))
+	for _, n := range names {
+		cs = append(cs, Candidate{NewLine: []rune(n), Display: []rune(n)})
+	}
+	return cs
+}
+
+var csiSequence = regexp.MustCompile("\033\\[[0-9;]*[A-Za-z]")
+
+// renderedGrid strips the escape sequences from the completion output and
+// returns the candidate rows with their cells separated by single spaces.
+func renderedGrid(out string) []string {
+	out = csiSequence.ReplaceAllString(out, "")
+	var rows []string
+	for _, row := range strings.Split(strings.Trim(out, "\r\n"), "\n") {
+		rows = append(rows, strings.Join(strings.Fields(row), " "))
+	}
+	return rows
+}
+
+func TestCompleteGridRuneWidthFunc(t *testing.T) {
+	// with 'w' taking three columns the cells are 4 columns wide, width 9
+	// leaves room for two of them
+	wide := func(r rune) int {
+		if r == 'w' {
+			return 3
+		}
+		return 1
+	}
+	o, w := newTestCompleter(&Config{RuneWidthFunc: wide}, 9)
+	o.EnterCompleteMode(testCandidates("a", "w", "b", "c"))
+
+	expected := []string{"a w", "b c"}
+	got := renderedGrid(w.String())
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+}
+
+func TestCompleteGridColumnMajor(t *testing.T) {
+	// width 7 leaves room for three 2-cell columns
+	o, w := newTestCompleter(&Config{CompletionColumnMajor: true}, 7)
+	o.EnterCompleteMode(testCandidates("a", "b", "c", "d", "e", "f", "g"))
+
+	expected := []string{"a d g", "b e", "c f"}
+	got := renderedGrid(w.String())
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+
+	moves := []struct {
+		key    rune
+		expect string
+	}{
+		{CharForward, "d"},
+		{CharForward, "g"},
+		{CharForward, "b"},
+		{CharNext, "c"},
+		{CharNext, "a"},
+		{CharPrev, "c"},
+		{CharLineEnd, "f"},
+		{CharPrev, "e"},
+		{CharBackward, "b"},
+		{CharBackward, "g"},
+		{CharNext, "g"},
+		{CharLineStart, "a"},
+		{CharTab, "b"},
+	}
+	for i, m := range moves {
+		o.HandleCompleteSelect(m.key)
+		if got := string(o.candidate[o.candidateChoise].Display); got != m.expect {
+			t.Fatalf("move %d: expected %q, got %q", i, m.expect, got)
+		}
+	}
+}
+
+func TestCompleteGridRowMajor(t *testing.T) {
+	o, w := newTestCompleter(&Config{}, 7)
+	o.EnterCompleteMode(testCandidates("a", "b", "c", "d", "e", "f", "g"))
+
+	expected := []string{"a b c", "d e f", "g"}
+	got := renderedGrid(w.String())
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+
+	moves := []struct {
+		key    rune
+		expect string
+	}{
+		{CharForward, "b"},
+		{CharNext, "e"},
+		{CharNext, "b"},
+		{CharPrev, "e"},
+		{CharLineEnd, "f"},
+		{CharForward, "g"},
+		{CharForward, "a"},
+		{CharBackward, "g"},
+		{CharPrev, "d"},
+		{CharLineStart, "d"},
+	}
+	for i, m := range moves {
+		o.HandleCompleteSelect(m.key)
+		if got := string(o.candidate[o.candidateChoise].Display); got != m.expect {
+			t.Fatalf("move %d: expected %q, got %q", i, m.expect, got)
+		}
+	}
+}
+
+func TestWriteCandidateShorterLine(t *testing.T) {
+	o, _ := newTestCompleter(&Config{}, 80)
+	cases := []struct {
+		source, newLine string
+	}{
+		{"cd ./foo/../bar", "cd ./bar"},
+		{"cd ./foo/../bar", "cd ./foo/../bar/"},
+		{"ls ~/", "ls /home/user/"},
+		{"abc", "xyz"},
+	}
+	for _, c := range cases {
+		o.op.buf.Set([]rune(c.source))
+		o.candidateSource = o.op.buf.Runes()
+		o.writeCandidate(Candidate{NewLine: []rune(c.newLine)})
+		if got := string(o.op.buf.Runes()); got != c.newLine {
+			t.Fatalf("%q: expected %q, got %q", c.source, c.newLine, got)
+		}
+		if pos := o.op.buf.Pos(); pos != len([]rune(c.newLine)) {
+			t.Fatalf("%q: unexpected cursor %d", c.source, pos)
+		}
+	}
+}
+
+func TestCompleteMidLine(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete: NewPrefixCompleter(PcItem("git"), PcItem("grep")),
+	})
+	// complete "gi" with the cursor after it, the rest of the line is kept
+	go w.Write([]byte("gi foo\x01\x06\x06\tX\r"))
+	expectLine(t, rl, "git X foo")
+
+	// picked from the candidates
+	go w.Write([]byte("g foo\x01\x06\t\t\rX\r"))
+	expectLine(t, rl, "git X foo")
+}
+
+func TestCompleteGridMaxColumns(t *testing.T) {
+	o, w := newTestCompleter(&Config{CompletionMaxColumns: 3}, 80)
+	o.EnterCompleteMode(testCandidates("a", "b", "c", "d", "e", "f", "g"))
+
+	expected := []string{"a b c", "d e f", "g"}
+	got := renderedGrid(w.String())
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+}
+
+func TestCompleteGridWiderThanScreen(t *testing.T) {
+	o, w := newTestCompleter(&Config{}, 10)
+	o.EnterCompleteMode(testCandidates("candidate-wider-than-screen", "b"))
+
+	expected := []string{"candidate-wider-than-screen", "b"}
+	got := renderedGrid(w.String())
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+}
+
+func TestCompleteRefreshLongCandidate(t *testing.T) {
+	o, w := newTestCompleter(&Config{}, 10)
+	o.op.buf.Set([]rune("x"))
+	o.EnterCompleteMode(testCandidates("a-candidate-of-25-columns"))
+
+	// the candidate wraps to 3 lines, the cursor should go back
+	// above all of them
+	if out := w.String(); !strings.Contains(out, "\033[3A") {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestCompleteGridGroups(t *testing.T) {
+	cs := testCandidates("a", "b", "c", "d", "e")
+	for i := range cs {
+		cs[i].Group = "Files"
+		if i < 2 {
+			cs[i].Group = "Commands"
+		}
+	}
+	o, w := newTestCompleter(&Config{}, 7)
+	o.EnterCompleteMode(cs)
+
+	expected := []string{"Commands", "a b", "Files", "c d e"}
+	got := renderedGrid(w.String())
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+
+	moves := []struct {
+		key    rune
+		expect string
+	}{
+		{CharNext, "c"},
+		{CharNext, "a"},
+		{CharPrev, "c"},
+		{CharLineEnd, "e"},
+		{CharPrev, "e"},
+		{CharForward, "a"},
+		{CharForward, "b"},
+		{CharForward, "c"},
+		{CharBackward, "b"},
+		{CharTab, "c"},
+	}
+	for i, m := range moves {
+		o.HandleCompleteSelect(m.key)
+		if got := string(o.candidate[o.candidateChoise].Display); got != m.expect {
+			t.Fatalf("move %d: expected %q, got %q", i, m.expect, got)
+		}
+	}
+}
+
+type dirAggregator struct {
+	AutoCompleter
+}
+
+func (d *dirAggregator) AggregateCandidates(cs []Candidate) (Candidate, bool) {
+	// merge to the common directory rather than the common prefix
+	return Candidate{NewLine: []rune("cd /usr/")}, true
+}
+
+func TestCompleteCustomAggregate(t *testing.T) {
+	cfg := &Config{AutoComplete: &dirAggregator{NewPrefixCompleter(
+		PcItem("cd /usr/local/bin"),
+		PcItem("cd /usr/lib"),
+	)}}
+	o, _ := newTestCompleter(cfg, 80)
+	o.op.buf.Set([]rune("cd /u"))
+	o.OnComplete()
+
+	if line := string(o.op.buf.Runes()); line != "cd /usr/" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if o.IsInCompleteMode() {
+		t.Fatal("should not show the candidates")
+	}
+}
+
+func TestMenuOnPrefixComplete(t *testing.T) {
+	cfg := &Config{AutoComplete: &dirAggregator{NewPrefixCompleter(
+		PcItem("cd /usr/local/bin"),
+		PcItem("cd /usr/lib"),
+	)}, MenuOnPrefixComplete: true}
+	o, w := newTestCompleter(cfg, 80)
+	o.op.buf.Set([]rune("cd /u"))
+	o.OnComplete()
+
+	if line := string(o.op.buf.Runes()); line != "cd /usr/" || !o.IsInCompleteMode() {
+		t.Fatalf("should extend the line and show the candidates: %q", line)
+	}
+	if got := renderedGrid(w.String()); len(got) != 1 || got[0] != "cd /usr/local/bin cd /usr/lib" {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+}
+
+type menuCompleter struct {
+	*dirAggregator
+	suppress bool
+}
+
+func (m *menuCompleter) SuppressAggregate() bool {
+	return m.suppress
+}
+
+func TestCompleteSuppressAggregate(t *testing.T) {
+	m := &menuCompleter{dirAggregator: &dirAggregator{NewPrefixCompleter(
+		PcItem("cd /usr/local/bin"),
+		PcItem("cd /usr/lib"),
+	)}, suppress: true}
+	o, w := newTestCompleter(&Config{AutoComplete: m}, 80)
+	o.op.buf.Set([]rune("cd /u"))
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "cd /u" || !o.IsInCompleteMode() {
+		t.Fatalf("should show the candidates: %q", line)
+	}
+	if got := renderedGrid(w.String()); len(got) != 1 || got[0] != "cd /usr/local/bin cd /usr/lib" {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+
+	// the completer is asked each time
+	o.ExitCompleteMode(false)
+	m.suppress = false
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "cd /usr/" || o.IsInCompleteMode() {
+		t.Fatalf("should merge the candidates: %q", line)
+	}
+}
+
+type describedCompleter struct {
+	AutoCompleter
+	description string
+}
+
+func (d *describedCompleter) Complete(line []rune, pos int) []Candidate {
+	return []Candidate{{
+		NewLine:     []rune("checkout"),
+		Display:     []rune("checkout"),
+		Description: []rune(d.description),
+	}}
+}
+
+func TestCompleteSingleCandidate(t *testing.T) {
+	o, _ := newTestCompleter(&Config{AutoComplete: &describedCompleter{}}, 80)
+	o.op.buf.Set([]rune("ch"))
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "checkout" || o.IsInCompleteMode() {
+		t.Fatalf("should insert the candidate: %q", line)
+	}
+
+	o, w := newTestCompleter(&Config{AutoComplete: &describedCompleter{
+		description: "switch branches",
+	}}, 80)
+	o.op.buf.Set([]rune("ch"))
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "ch" || !o.IsInCompleteMode() {
+		t.Fatalf("should show the candidate: %q", line)
+	}
+	if got := renderedGrid(w.String()); len(got) != 1 || got[0] != "checkout switch branches" {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+
+	// pressing Tab again confirms it
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "checkout" || o.IsInCompleteMode() {
+		t.Fatalf("should insert the candidate: %q", line)
+	}
+}
+
+type fixedCompleter struct {
+	lines  [][]rune
+	length int
+}
+
+func (f *fixedCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	return f.lines, f.length
+}
+
+func TestCompleterAdapter(t *testing.T) {
+	ret := []struct {
+		completer AutoCompleter
+		line      string
+		pos       int
+		newLines  []string
+		displays  []string
+	}{
+		{
+			NewPrefixCompleter(PcItem("go"), PcItem("git")),
+			"", 0,
+			[]string{"go ", "git "},
+			[]string{"go ", "git "},
+		},
+		{
+			&fixedCompleter{[][]rune{[]rune("help")}, 2},
+			"", 0,
+			[]string{"help"},
+			[]string{"help"},
+		},
+		{
+			&fixedCompleter{[][]rune{[]rune("o"), []rune("it")}, 1},
+			"g x", 1,
+			[]string{"go x", "git x"},
+			[]string{"go", "git"},
+		},
+	}
+	for i, r := range ret {
+		cs := (&completerAdapter{r.completer}).Complete([]rune(r.line), r.pos)
+		var newLines, displays []string
+		for _, c := range cs {
+			newLines = append(newLines, string(c.NewLine))
+			displays = append(displays, string(c.Display))
+		}
+		if strings.Join(newLines, "|") != strings.Join(r.newLines, "|") {
+			t.Fatalf("%d: unexpected lines %q", i, newLines)
+		}
+		if strings.Join(displays, "|") != strings.Join(r.displays, "|") {
+			t.Fatalf("%d: unexpected displays %q", i, displays)
+		}
+	}
+}
+
+func TestCompleteMaxDisplayWidth(t *testing.T) {
+	o, w := newTestCompleter(&Config{CompletionMaxDisplayWidth: 10}, 80)
+	o.op.buf.Set([]rune("/usr/"))
+	o.candidateSource = o.op.buf.Runes()
+	o.EnterCompleteMode(testCandidates("/usr/local/share/doc", "/usr/lib"))
+
+	if got := renderedGrid(w.String()); strings.Join(got, "|") != "/usr/loca… /usr/lib" {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+	o.HandleCompleteSelect(CharEnter)
+	if line := string(o.op.buf.Runes()); line != "/usr/local/share/doc" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestCompleteCandidatePrefix(t *testing.T) {
+	cs := testCandidates("bin", "run", "tmp")
+	cs[0].Prefix = []rune("目 ")
+	cs[1].Prefix = []rune("* ")
+	o, w := newTestCompleter(&Config{}, 30)
+	o.EnterCompleteMode(cs)
+
+	// the columns are 7 cells wide, the prefixes included
+	out := csiSequence.ReplaceAllString(w.String(), "")
+	if !strings.Contains(out, "目 bin * run  tmp    ") {
+		t.Fatalf("unexpected grid: %q", out)
+	}
+
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+	o.HandleCompleteSelect(CharEnter)
+	if line := string(o.op.buf.Runes()); line != "bin" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+type recordingRenderer struct {
+	calls []string
+}
+
+func (r *recordingRenderer) Render(cs []Candidate, selected int, width int) {
+	var names []string
+	for _, c := range cs {
+		names = append(names, string(c.Display))
+	}
+	r.calls = append(r.calls, fmt.Sprintf("%s:%d:%d", strings.Join(names, ","), selected, width))
+}
+
+func TestCompletionRenderer(t *testing.T) {
+	r := &recordingRenderer{}
+	o, w := newTestCompleter(&Config{CompletionRenderer: r}, 80)
+	o.EnterCompleteMode(testCandidates("a", "b", "c"))
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+	o.HandleCompleteSelect(CharNext)
+	o.HandleCompleteSelect(CharEnter)
+
+	expected := []string{"a,b,c:-1:80", "a,b,c:-1:80", "a,b,c:0:80", "a,b,c:1:80", ":-1:80"}
+	if strings.Join(r.calls, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected calls %q", r.calls)
+	}
+	if w.Len() != 0 {
+		t.Fatalf("unexpected output %q", w.String())
+	}
+	if line := string(o.op.buf.Runes()); line != "b" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestOnCompleteModeChange(t *testing.T) {
+	var calls []bool
+	o, _ := newTestCompleter(&Config{
+		OnCompleteModeChange: func(active bool) { calls = append(calls, active) },
+	}, 80)
+	o.ExitCompleteMode(false)
+	o.EnterCompleteMode(testCandidates("a", "b"))
+	o.EnterCompleteMode(testCandidates("a"))
+	if fmt.Sprint(calls) != "[true]" {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+	o.ExitCompleteMode(false)
+	o.ExitCompleteMode(false)
+	if fmt.Sprint(calls) != "[true false]" {
+		t.Fatalf("unexpected calls %v", calls)
+	}
+}
+
+func TestCompletionPreview(t *testing.T) {
+	o, w := newTestCompleter(&Config{ShowCompletionPreview: true}, 80)
+	o.op.buf.WriteString("git co")
+	o.candidateSource = o.op.buf.Runes()
+	o.EnterCompleteMode([]Candidate{
+		{NewLine: []rune("checkout"), Display: []rune("checkout"), ReplaceStart: 4, ReplaceEnd: 6},
+		{NewLine: []rune("commit"), Display: []rune("commit"), ReplaceStart: 4, ReplaceEnd: 6},
+	})
+	o.EnterCompleteSelectMode()
+
+	for _, expect := range []string{"git checkout", "git commit"} {
+		w.Reset()
+		o.HandleCompleteSelect(o.op.cfg.CompleteKey)
+		// the grid is drawn again by each refresh, check the last one
+		rows := renderedGrid(w.String())
+		rows = rows[len(rows)-2:]
+		if rows[0] != "checkout commit" || rows[1] != expect {
+			t.Fatalf("unexpected rows %q", rows)
+		}
+		// back over the grid row and the preview
+		if !strings.Contains(w.String(), "\033[2A\r\033[6C") {
+			t.Fatalf("unexpected cursor restoration %q", w.String())
+		}
+	}
+	if line := string(o.op.buf.Runes()); line != "git co" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+// lockedBuffer is written by the ioloop and by Readline leaving the raw
+// mode at once.
+type lockedBuffer struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.Buffer.String()
+}
+
+func TestMouseClickCandidate(t *testing.T) {
+	out := &lockedBuffer{}
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:   NewPrefixCompleter(PcItem("hello"), PcItem("help"), PcItem("helium")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		EnableMouse:    true,
+	})
+	// the cells are 8 columns wide and the grid is on the row 11, below
+	// the line reported on the row 10
+	go w.Write([]byte("he\t\033[10;3R\033[<0;12;11M\r"))
+	expectLine(t, rl, "help ")
+	output := out.String()
+	if !strings.Contains(output, "\033[6n") {
+		t.Fatalf("the cursor row isn't asked for: %q", output)
+	}
+	if !strings.HasPrefix(output, "\033[?1000h\033[?1006h") ||
+		!strings.Contains(output, "\033[?1006l\033[?1000l") {
+		t.Fatalf("the mouse reporting isn't toggled: %q", output)
+	}
+
+	// the X10 encoding, a click outside of the grid and a release do nothing
+	go w.Write([]byte("he\t\033[<0;12;12M\033[<0;12;11m\033[M\x20\x34\x2b\r"))
+	expectLine(t, rl, "helium ")
+}
+
+func TestCompleteResize(t *testing.T) {
+	out := &lockedBuffer{}
+	var width int32 = 80
+	resized := make(chan func(), 1)
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:       NewPrefixCompleter(PcItem("hello"), PcItem("help"), PcItem("helium"), PcItem("helix")),
+		Stdout:             out,
+		FuncIsTerminal:     func() bool { return true },
+		FuncGetWidth:       func() int { return int(atomic.LoadInt32(&width)) },
+		FuncOnWidthChanged: func(f func()) { resized <- f },
+	})
+	onResize := <-resized
+	done := make(chan string)
+	go func() {
+		line, _ := rl.Readline()
+		done <- line
+	}()
+	go w.Write([]byte("he\t"))
+	first := waitOutput(t, out, 0, "helix")
+	if !strings.Contains(strings.Join(renderedGrid(first), "|"), "hello help helium helix") {
+		t.Fatalf("unexpected grid: %q", renderedGrid(first))
+	}
+	before := len(first)
+
+	atomic.StoreInt32(&width, 18)
+	onResize()
+	after := waitOutput(t, out, before, "helix")
+	expected := []string{"he", "hello help", "helium helix"}
+	if got := renderedGrid(after); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected grid: %q", got)
+	}
+	go w.Write([]byte("\x07\r"))
+	if line := <-done; line != "he" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+// waitOutput waits for text to be written to out after its first from
+// bytes, and returns what was written after them.
+func waitOutput(t *testing.T, out *lockedBuffer, from int, text string) string {
+	deadline := time.Now().Add(time.Second)
+	for {
+		if written := out.String()[from:]; strings.Contains(written, text) {
+			return written
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q isn't written: %q", text, out.String()[from:])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApplyCandidate(t *testing.T) {
+	completer := NewPrefixCompleter(PcItem("hello"), PcItem("help"))
+	rl, w := newTestInstance(t, &Config{AutoComplete: completer})
+	// picked from the candidates
+	go w.Write([]byte("he\t\t\rx\r"))
+	expectLine(t, rl, "hello x")
+
+	cs := (&completerAdapter{completer}).Complete([]rune("he"), 2)
+	rl.SetBuffer("he", 2)
+	rl.ApplyCandidate(cs[0])
+	go w.Write([]byte("x\r"))
+	expectLine(t, rl, "hello x")
+
+	// the cursor moves after the replaced range
+	rl.SetBuffer("he wor", 2)
+	rl.ApplyCandidate(Candidate{NewLine: []rune("help"), ReplaceStart: 0, ReplaceEnd: 2})
+	go w.Write([]byte("X\r"))
+	expectLine(t, rl, "helpX wor")
+}
+
+func TestApplyCandidateNoWait(t *testing.T) {
+	ticks := make(chan time.Time)
+	typed := make(chan struct{})
+	var rl *Instance
+	rl, w := newTestInstance(t, &Config{
+		Listener: FuncListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+			if key == 'e' {
+				typed <- struct{}{}
+			}
+			return nil, 0, false
+		}),
+		TickInterval: time.Second,
+		OnTick: func() {
+			// called by the line editor, which can't take c meanwhile
+			rl.ApplyCandidate(Candidate{NewLine: []rune("hello"), ReplaceStart: 0, ReplaceEnd: 2})
+		},
+		funcNewTicker: func(time.Duration) (<-chan time.Time, func()) {
+			return ticks, func() {}
+		},
+	})
+	result := make(chan string)
+	go func() {
+		line, _ := rl.Readline()
+		result <- line
+	}()
+	w.Write([]byte("he"))
+	<-typed
+	ticks <- time.Now()
+	w.Write([]byte("!\r"))
+	if line := <-result; line != "hello!" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	// dropped once closed
+	rl.Close()
+	done := make(chan struct{})
+	go func() {
+		rl.ApplyCandidate(Candidate{NewLine: []rune("x")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ApplyCandidate blocks after Close")
+	}
+}
+
+func TestBellOnAmbiguous(t *testing.T) {
+	for _, bell := range []bool{false, true} {
+		out := &lockedBuffer{}
+		rl, w := newTestInstance(t, &Config{
+			AutoComplete:    NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+			Stdout:          out,
+			FuncIsTerminal:  func() bool { return true },
+			BellOnAmbiguous: bell,
+		})
+		// a unique candidate
+		go w.Write([]byte("hell\t\r"))
+		expectLine(t, rl, "hello ")
+		if strings.Contains(out.String(), "\a") {
+			t.Fatalf("bell on a unique candidate: %q", out.String())
+		}
+		// the menu opens, moving in it rings no more
+		go w.Write([]byte("hel\t\t\t\x07\r"))
+		expectLine(t, rl, "hel")
+		// Ctrl-G rings anyway
+		expected := 1
+		if bell {
+			expected++
+		}
+		if n := strings.Count(out.String(), "\a"); n != expected {
+			t.Fatalf("BellOnAmbiguous %v: %d bells: %q", bell, n, out.String())
+		}
+	}
+}
+
+// numberCandidates numbers the candidates as they're shown.
+func numberCandidates(cs []Candidate) []Candidate {
+	for i := range cs {
+		cs[i].Display = []rune(fmt.Sprintf("%d) %s", i+1, string(cs[i].Display)))
+	}
+	return cs
+}
+
+func TestCompletionDisplayTransform(t *testing.T) {
+	out := &lockedBuffer{}
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:               NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+		Stdout:                     out,
+		FuncIsTerminal:             func() bool { return true },
+		CompletionDisplayTransform: numberCandidates,
+	})
+	// select the second candidate
+	go w.Write([]byte("hel\t\t\t\r\r"))
+	expectLine(t, rl, "help ")
+	output := out.String()
+	if !strings.Contains(output, "1) hello") || !strings.Contains(output, "2) help") {
+		t.Fatalf("the candidates aren't numbered: %q", output)
+	}
+	// each redraw transforms the candidates afresh
+	if strings.Contains(output, "1) 1)") {
+		t.Fatalf("the candidates are numbered twice: %q", output)
+	}
+}
+
+func TestCompletionQuickSelect(t *testing.T) {
+	completer := NewPrefixCompleter(PcItem("hello"), PcItem("help"), PcItem("helium"))
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:               completer,
+		CompletionDisplayTransform: numberCandidates,
+		CompletionQuickSelect:      true,
+	})
+	// the second Tab selects the first candidate
+	go w.Write([]byte("hel\t\t2x\r"))
+	expectLine(t, rl, "help x")
+	// no fourth candidate, the first one stays selected
+	go w.Write([]byte("hel\t\t4\r\r"))
+	expectLine(t, rl, "hello ")
+	// the digits are typed before a candidate is selected
+	go w.Write([]byte("hel\t2\r"))
+	expectLine(t, rl, "hel2")
+
+	rl, w = newTestInstance(t, &Config{AutoComplete: completer})
+	go w.Write([]byte("hel\t\t2\r"))
+	expectLine(t, rl, "hel2")
+}
+
+func TestCompletionAcceptKeys(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:         NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+		CompletionAcceptKeys: []rune{CharForward, MetaKey('a')},
+	})
+	// select "help", accept it with Right and type after it
+	go w.Write([]byte("he\t\t\t\033[Cx\r"))
+	expectLine(t, rl, "help x")
+	go w.Write([]byte("he\t\t\033ax\r"))
+	expectLine(t, rl, "hello x")
+}
+
+// pathCompleter completes the files of a fixed tree, the directories end
+// with a slash.
+type pathCompleter struct {
+	AutoCompleter
+}
+
+func (pathCompleter) Complete(line []rune, pos int) []Candidate {
+	files := []string{"src/", "setup.go", "src/main.go", "src/util/"}
+	dir := string(line[:pos])
+	if i := strings.LastIndex(dir, "/"); i >= 0 {
+		dir = dir[:i+1]
+	} else {
+		dir = ""
+	}
+	var cs []Candidate
+	for _, f := range files {
+		rest := strings.TrimPrefix(f, dir)
+		if strings.HasPrefix(f, string(line[:pos])) && rest != "" && !strings.Contains(strings.TrimSuffix(rest, "/"), "/") {
+			cs = append(cs, Candidate{NewLine: []rune(f), Display: []rune(rest)})
+		}
+	}
+	return cs
+}
+
+func TestReopenCompletionAfterAccept(t *testing.T) {
+	var accepted []string
+	o, w := newTestCompleter(&Config{
+		AutoComplete: pathCompleter{},
+		ReopenCompletionAfterAccept: func(c Candidate) bool {
+			accepted = append(accepted, string(c.NewLine))
+			return strings.HasSuffix(string(c.NewLine), "/")
+		},
+	}, 80)
+	o.op.buf.Set([]rune("s"))
+	o.OnComplete()
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+	w.Reset()
+	o.HandleCompleteSelect(CharEnter)
+
+	// the directory is completed in turn
+	if line := string(o.op.buf.Runes()); line != "src/" || !o.IsInCompleteMode() {
+		t.Fatalf("the completion should go on: %q", line)
+	}
+	if got := renderedGrid(w.String()); got[len(got)-1] != "main.go util/" {
+		t.Fatalf("unexpected grid %q", got)
+	}
+
+	// a file ends it
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+	o.HandleCompleteSelect(CharEnter)
+	if line := string(o.op.buf.Runes()); line != "src/main.go" || o.IsInCompleteMode() {
+		t.Fatalf("the completion should end: %q", line)
+	}
+	if strings.Join(accepted, ",") != "src/,src/main.go" {
+		t.Fatalf("unexpected accepted candidates %q", accepted)
+	}
+}
+
+type typoCompleter struct {
+	AutoCompleter
+}
+
+func (typoCompleter) Complete(line []rune, pos int) []Candidate {
+	return []Candidate{{
+		NewLine:      []rune("checkout"),
+		Display:      []rune("checkout"),
+		ReplaceStart: 4,
+		ReplaceEnd:   12,
+	}}
+}
+
+func TestCompleteReplaceRange(t *testing.T) {
+	o, _ := newTestCompleter(&Config{AutoComplete: typoCompleter{}}, 80)
+	o.op.buf.Set([]rune("git chekcout main"))
+	o.op.buf.MoveCursor(-10)
+	o.OnComplete()
+
+	if line := string(o.op.buf.Runes()); line != "git checkout main" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if pos := o.op.buf.Pos(); pos != 12 {
+		t.Fatalf("unexpected cursor %d", pos)
+	}
+}
+
+func TestCompleteNarrowedToOne(t *testing.T) {
+	o, _ := newTestCompleter(&Config{AutoComplete: NewPrefixCompleter(
+		PcItem("hello"), PcItem("help"), PcItem("world"),
+	)}, 80)
+	o.op.buf.Set([]rune("he"))
+	o.OnComplete()
+	if !o.IsInCompleteMode() || len(o.candidate) != 2 {
+		t.Fatalf("should show the candidates: %d", len(o.candidate))
+	}
+
+	// typing narrows the candidates down to one, Tab inserts it
+	o.op.buf.WriteString("lp")
+	o.OnComplete()
+	if !o.IsInCompleteMode() || len(o.candidate) != 1 {
+		t.Fatalf("unexpected candidates: %d", len(o.candidate))
+	}
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "help " || o.IsInCompleteMode() {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
+
+func TestCompletionSort(t *testing.T) {
+	dirsFirst := func(cs []Candidate) []Candidate {
+		sort.SliceStable(cs, func(i, j int) bool {
+			isDir := func(c Candidate) bool {
+				return strings.HasSuffix(strings.TrimSpace(string(c.Display)), "/")
+			}
+			return isDir(cs[i]) && !isDir(cs[j])
+		})
+		return cs
+	}
+	o, _ := newTestCompleter(&Config{
+		AutoComplete: NewPrefixCompleter(
+			PcItem("a.txt"), PcItem("b/"), PcItem("c.go"), PcItem("d/"),
+		),
+		CompletionSort: dirsFirst,
+	}, 80)
+	o.OnComplete()
+
+	var names []string
+	for _, c := range o.candidate {
+		names = append(names, string(c.Display))
+	}
+	if got := strings.Join(names, ","); got != "b/ ,d/ ,a.txt ,c.go " {
+		t.Fatalf("unexpected order %q", got)
+	}
+}
+
+type lazyCompleter struct {
+	AutoCompleter
+	names []string
+	calls map[string]int
+}
+
+func (l *lazyCompleter) Complete(line []rune, pos int) []Candidate {
+	var cs []Candidate
+	for _, n := range l.names {
+		if !strings.HasPrefix(n, string(line)) {
+			continue
+		}
+		n := n
+		cs = append(cs, Candidate{
+			NewLine: []rune(n),
+			DisplayFunc: func() []rune {
+				l.calls[n]++
+				return []rune("[" + n + "]")
+			},
+		})
+	}
+	return cs
+}
+
+func TestCandidateDisplayFunc(t *testing.T) {
+	l := &lazyCompleter{names: []string{"main.go", "go.mod", "go.sum"}, calls: map[string]int{}}
+	o, w := newTestCompleter(&Config{AutoComplete: l}, 80)
+
+	// a unique candidate is inserted without being shown
+	o.op.buf.Set([]rune("ma"))
+	o.OnComplete()
+	if len(l.calls) != 0 {
+		t.Fatalf("unexpected calls %v", l.calls)
+	}
+
+	o.op.buf.Set([]rune("go."))
+	o.OnComplete()
+	o.EnterCompleteSelectMode()
+	o.doSelect()
+	o.HandleCompleteSelect(CharNext)
+	if l.calls["go.mod"] != 1 || l.calls["go.sum"] != 1 || len(l.calls) != 2 {
+		t.Fatalf("unexpected calls %v", l.calls)
+	}
+	if !strings.Contains(w.String(), "[go.mod]") {
+		t.Fatalf("unexpected output %q", w.String())
+	}
+}
+
+func TestCompleteColoredDescriptions(t *testing.T) {
+	cs := []Candidate{
+		{NewLine: []rune("go.mod"), Display: []rune("\033[34mgo.mod\033[0m"),
+			Description: []rune("\033[2mmodule definition\033[0m")},
+		{NewLine: []rune("main.go"), Display: []rune("main.go"),
+			Description: []rune("source")},
+	}
+	o, w := newTestCompleter(&Config{}, 24)
+	o.EnterCompleteMode(cs)
+
+	out := csiSequence.ReplaceAllString(w.String(), "")
+	rows := strings.Split(strings.Trim(out, "\r\n"), "\n")
+	// the descriptions line up and the long one is cut to fit the screen
+	expected := []string{"go.mod   module defini…", "main.go  source"}
+	if strings.Join(rows, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected rows %q", rows)
+	}
+}
+
+type streamCompleter struct {
+	AutoCompleter
+	stream chan Candidate
+}
+
+func (s *streamCompleter) CompleteStream(line []rune, pos int) <-chan Candidate {
+	return s.stream
+}
+
+func TestCompleteStream(t *testing.T) {
+	s := &streamCompleter{stream: make(chan Candidate, 3)}
+	o, w := newTestCompleter(&Config{AutoComplete: s}, 80)
+	o.op.buf.Set([]rune("g"))
+	o.OnComplete()
+	if !o.IsInCompleteMode() || len(o.candidate) != 0 {
+		t.Fatal("should wait for the candidates")
+	}
+
+	// each candidate is shown as it comes, even a single one
+	expected := []string{"go", "go git", "go git grep"}
+	for i, name := range []string{"go", "git", "grep"} {
+		s.stream <- Candidate{NewLine: []rune(name), Display: []rune(name)}
+		w.Reset()
+		c, ok := <-o.op.stream
+		o.onStream(c, ok)
+		if got := renderedGrid(w.String()); len(got) != 1 || got[0] != expected[i] {
+			t.Fatalf("unexpected grid %q", got)
+		}
+	}
+	close(s.stream)
+	c, ok := <-o.op.stream
+	o.onStream(c, ok)
+	if o.op.stream != nil || len(o.candidate) != 3 {
+		t.Fatal("the stream should be done")
+	}
+
+	// Tab selects them
+	o.OnComplete()
+	if !o.IsInCompleteSelectMode() || o.candidateChoise != 0 {
+		t.Fatalf("should select the first candidate: %d", o.candidateChoise)
+	}
+}
+
+func TestCompleteColumnSep(t *testing.T) {
+	o, w := newTestCompleter(&Config{CompletionColumnSep: " │ "}, 16)
+	o.EnterCompleteMode(testCandidates("a", "bb", "ccc", "dd"))
+
+	out := csiSequence.ReplaceAllString(w.String(), "")
+	rows := strings.Split(strings.Trim(out, "\r\n"), "\n")
+	expected := []string{"a   │ bb  │ ccc", "dd "}
+	if strings.Join(rows, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected rows %q", rows)
+	}
+	for _, row := range rows {
+		if width := runes.WidthAll([]rune(row)); width > 15 {
+			t.Fatalf("row %q wider than the screen", row)
+		}
+	}
+}
+
+func TestCompleteColumnSepEmpty(t *testing.T) {
+	// no width at all for the columns, one per line
+	o, _ := newTestCompleter(&Config{CompletionColumnSep: "\033[2m\033[0m"}, 16)
+	o.EnterCompleteMode([]Candidate{{NewLine: []rune("a")}, {NewLine: []rune("b")}})
+	if o.candidateColNum != 1 {
+		t.Fatalf("unexpected column count %d", o.candidateColNum)
+	}
+}
+
+func TestCompleteHighlightTyped(t *testing.T) {
+	o, w := newTestCompleter(&Config{
+		AutoComplete:             NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+		CompletionHighlightTyped: true,
+	}, 80)
+	o.op.buf.Set([]rune("he"))
+	o.OnComplete()
+
+	// the padding ignores the color sequences
+	expected := "\033[1mhe\033[22mllo  \033[1mhe\033[22mlp  "
+	if !strings.Contains(w.String(), expected) {
+		t.Fatalf("unexpected output %q", w.String())
+	}
+}
+
+func TestCompleteGridNoAutowrap(t *testing.T) {
+	o, w := newTestCompleter(&Config{gridNoAutowrap: true}, 10)
+	o.op.buf.Set([]rune("x"))
+	o.EnterCompleteMode(testCandidates("a-candidate-of-25-columns", "b"))
+
+	out := w.String()
+	start, end := strings.Index(out, "\033[?7l"), strings.Index(out, "\033[?7h")
+	if start < 0 || end < start {
+		t.Fatalf("the grid should be bracketed: %q", out)
+	}
+	if grid := renderedGrid(out[start+len("\033[?7l") : end]); strings.Join(grid, "|") != "a-candidate-of-25-columns|b" {
+		t.Fatalf("unexpected grid %q", grid)
+	}
+	// the long candidate is cut, it takes a single line
+	if !strings.Contains(out[end:], "\033[2A") {
+		t.Fatalf("unexpected output %q", out[end:])
+	}
+}
@@ -0,0 +1,82 @@
+package readline
+
+import (
+	"sort"
+	"strings"
+)
+
+// TreeCompleter completes a command line whose arguments depend on the
+// words before them, e.g. the branches after "git checkout" and the remotes
+// after "git remote". See NewTreeCompleter.
+type TreeCompleter struct {
+	spec map[string]AutoCompleterWithCandidates
+	// the words following each path, from the paths of spec
+	next map[string][]string
+}
+
+// NewTreeCompleter returns a completer dispatching on the words before the
+// one being completed. The keys of spec are command paths, words separated
+// by single spaces (e.g. "git checkout"), and their completer is asked for
+// the words after them. The words of the paths are candidates themselves,
+// e.g. "checkout" after "git" and "git" at the start of the line, so a
+// path may have a nil completer.
+func NewTreeCompleter(spec map[string]AutoCompleterWithCandidates) *TreeCompleter {
+	t := &TreeCompleter{spec: spec, next: map[string][]string{}}
+	for path := range spec {
+		words := strings.Fields(path)
+		for i := range words {
+			parent := strings.Join(words[:i], " ")
+			if !containsString(t.next[parent], words[i]) {
+				t.next[parent] = append(t.next[parent], words[i])
+			}
+		}
+	}
+	for _, words := range t.next {
+		sort.Strings(words)
+	}
+	return t
+}
+
+func containsString(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TreeCompleter) Complete(line []rune, pos int) []Candidate {
+	segments, _ := SplitSegment(line, pos)
+	word := segments[len(segments)-1]
+	var words []string
+	for _, s := range segments[:len(segments)-1] {
+		if len(s) > 0 {
+			words = append(words, string(s))
+		}
+	}
+	path := strings.Join(words, " ")
+
+	var cs []Candidate
+	start := pos - len(word)
+	for _, w := range t.next[path] {
+		if !strings.HasPrefix(w, string(word)) {
+			continue
+		}
+		newLine := append(runes.Copy(line[:start]), []rune(w+" ")...)
+		cs = append(cs, Candidate{
+			NewLine: append(newLine, line[pos:]...),
+			Display: []rune(w),
+		})
+	}
+	if c := t.spec[path]; c != nil {
+		cs = append(cs, c.Complete(line, pos)...)
+	}
+	return cs
+}
+
+// Do returns nothing, Readline only asks Complete for the candidates of an
+// AutoCompleterWithCandidates.
+func (t *TreeCompleter) Do(line []rune, pos int) ([][]rune, int) {
+	return nil, 0
+}
@@ -0,0 +1,63 @@
+package readline
+
+import (
+	"testing"
+)
+
+// wordsCompleter offers its words in place of the one before the cursor.
+type wordsCompleter []string
+
+func (w wordsCompleter) Complete(line []rune, pos int) []Candidate {
+	start := pos
+	for start > 0 && line[start-1] != ' ' {
+		start--
+	}
+	var cs []Candidate
+	for _, word := range w {
+		if runes.HasPrefix([]rune(word), line[start:pos]) {
+			newLine := append(runes.Copy(line[:start]), []rune(word)...)
+			cs = append(cs, Candidate{NewLine: newLine, Display: []rune(word)})
+		}
+	}
+	return cs
+}
+
+func TestTreeCompleter(t *testing.T) {
+	c := NewTreeCompleter(map[string]AutoCompleterWithCandidates{
+		"git checkout": wordsCompleter{"main", "feature"},
+		"git remote":   wordsCompleter{"origin"},
+		"ls":           nil,
+	})
+
+	ret := []struct {
+		line     string
+		expected string
+	}{
+		{"", "git =git,ls =ls"},
+		{"g", "git =git"},
+		{"git ", "git checkout =checkout,git remote =remote"},
+		{"git ch", "git checkout =checkout"},
+		{"git checkout ", "git checkout main=main,git checkout feature=feature"},
+		{"git checkout f", "git checkout feature=feature"},
+		{"git  remote ", "git  remote origin=origin"},
+		{"git remote o", "git remote origin=origin"},
+		{"ls ", ""},
+		{"svn ", ""},
+	}
+	for _, r := range ret {
+		line := []rune(r.line)
+		if got := candidateLines(c.Complete(line, len(line))); got != r.expected {
+			t.Fatalf("%q: unexpected candidates %q", r.line, got)
+		}
+	}
+
+	// the subcommand is completed, then its argument
+	o, _ := newTestCompleter(&Config{AutoComplete: c}, 80)
+	o.op.buf.Set([]rune("git ch"))
+	o.OnComplete()
+	o.op.buf.WriteString("ma")
+	o.OnComplete()
+	if line := string(o.op.buf.Runes()); line != "git checkout main" {
+		t.Fatalf("unexpected line %q", line)
+	}
+}
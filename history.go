@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"container/list"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
 )
 
+// hisItem is a history entry, the edits made to it while recalled are kept
+// in Tmp until a line is accepted, i.e. as long as Version is the current
+// version of the history. They're only shown again with
+// Config.PreserveHistoryEdits.
 type hisItem struct {
 	Source  []rune
 	Version int64
@@ -28,6 +33,9 @@ type opHistory struct {
 	fd         *os.File
 	fdLock     sync.Mutex
 	enable     bool
+
+	// the last entry loaded from the history file
+	sessionStart *list.Element
 }
 
 func newOpHistory(cfg *Config) (o *opHistory) {
@@ -42,6 +50,7 @@ func newOpHistory(cfg *Config) (o *opHistory) {
 func (o *opHistory) Reset() {
 	o.history = list.New()
 	o.current = nil
+	o.sessionStart = nil
 }
 
 func (o *opHistory) IsHistoryClosed() bool {
@@ -66,7 +75,7 @@ func (o *opHistory) initHistory() {
 func (o *opHistory) historyUpdatePath(path string) {
 	o.fdLock.Lock()
 	defer o.fdLock.Unlock()
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, o.cfg.HistoryFilePerm)
 	if err != nil {
 		return
 	}
@@ -89,6 +98,7 @@ func (o *opHistory) historyUpdatePath(path string) {
 	if total > o.cfg.HistoryLimit {
 		o.rewriteLocked()
 	}
+	o.sessionStart = o.history.Back()
 	o.historyVer++
 	o.Push(nil)
 	return
@@ -111,24 +121,18 @@ func (o *opHistory) rewriteLocked() {
 		return
 	}
 
-	tmpFile := o.cfg.HistoryFile + ".tmp"
-	fd, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0666)
+	fd, err := writeFileAtomic(o.cfg.HistoryFile, o.cfg.HistoryFilePerm, func(w io.Writer) error {
+		for elem := o.history.Front(); elem != nil; elem = elem.Next() {
+			if _, err := io.WriteString(w, string(elem.Value.(*hisItem).Source)+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return
 	}
 
-	buf := bufio.NewWriter(fd)
-	for elem := o.history.Front(); elem != nil; elem = elem.Next() {
-		buf.WriteString(string(elem.Value.(*hisItem).Source) + "\n")
-	}
-	buf.Flush()
-
-	// replace history file
-	if err = os.Rename(tmpFile, o.cfg.HistoryFile); err != nil {
-		fd.Close()
-		return
-	}
-
 	if o.fd != nil {
 		o.fd.Close()
 	}
@@ -136,6 +140,36 @@ func (o *opHistory) rewriteLocked() {
 	o.fd = fd
 }
 
+// writeFileAtomic replaces the file at path by what write writes, through
+// a temporary file renamed over it once complete: a failure or a crash
+// leaves the previous content in place. The new file is returned opened
+// for appending.
+func writeFileAtomic(path string, perm os.FileMode, write func(w io.Writer) error) (*os.File, error) {
+	tmpFile := path + ".tmp"
+	fd, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bufio.NewWriter(fd)
+	err = write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, path)
+	}
+	if err != nil {
+		fd.Close()
+		os.Remove(tmpFile)
+		return nil, err
+	}
+	return fd, nil
+}
+
 func (o *opHistory) Close() {
 	o.fdLock.Lock()
 	defer o.fdLock.Unlock()
@@ -144,29 +178,86 @@ func (o *opHistory) Close() {
 	}
 }
 
+// HistoryIterator walks through the history from the most recent entry
+// to the oldest one, it lets the backward search (Ctrl-R) stream the entries
+// of a large history (e.g. stored in a database) without loading all of them.
+type HistoryIterator interface {
+	// Prev returns the next older entry, ok is false when there are no more.
+	Prev() (line string, ok bool)
+}
+
+// historyIterator is the HistoryIterator of the in-memory history.
+type historyIterator struct {
+	history *opHistory
+	elem    *list.Element
+}
+
+// iterator returns a HistoryIterator over the entries older than elem.
+func (o *opHistory) iterator(elem *list.Element) *historyIterator {
+	return &historyIterator{history: o, elem: elem}
+}
+
+func (it *historyIterator) Prev() (string, bool) {
+	if it.elem == nil {
+		return "", false
+	}
+	it.elem = it.elem.Prev()
+	if it.elem == nil {
+		return "", false
+	}
+	return string(it.history.showItem(it.elem)), true
+}
+
 func (o *opHistory) FindBck(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
-	for elem := o.current; elem != nil; elem = elem.Prev() {
-		item := o.showItem(elem.Value)
-		if isNewSearch {
-			start += len(rs)
+	if o.current == nil {
+		return -1, nil
+	}
+	// the current entry is only searched before the cursor
+	item := o.showItem(o.current)
+	if isNewSearch {
+		start += len(rs)
+	}
+	if len(item) >= start {
+		item = item[:start]
+	}
+	if idx := runes.IndexAllBckEx(item, rs, o.cfg.HistorySearchFold); idx >= 0 {
+		return idx, o.current
+	}
+
+	it := o.iterator(o.current)
+	for line, ok := it.Prev(); ok; line, ok = it.Prev() {
+		if idx := runes.IndexAllBckEx([]rune(line), rs, o.cfg.HistorySearchFold); idx >= 0 {
+			return idx, it.elem
 		}
-		if elem == o.current {
-			if len(item) >= start {
-				item = item[:start]
-			}
+	}
+	return -1, nil
+}
+
+// FindPrefix moves to the closest entry older (or newer unless backward)
+// than the current one starting with prefix, and returns it.
+func (o *opHistory) FindPrefix(prefix []rune, backward bool) ([]rune, bool) {
+	if o.current == nil {
+		return nil, false
+	}
+	next := (*list.Element).Next
+	if backward {
+		next = (*list.Element).Prev
+	}
+	for elem := next(o.current); elem != nil; elem = next(elem) {
+		if backward && o.cfg.SessionOnlyHistoryNavigation && elem == o.sessionStart {
+			break
 		}
-		idx := runes.IndexAllBckEx(item, rs, o.cfg.HistorySearchFold)
-		if idx < 0 {
-			continue
+		if item := o.showItem(elem); runes.HasPrefix(item, prefix) {
+			o.current = elem
+			return runes.Copy(item), true
 		}
-		return idx, elem
 	}
-	return -1, nil
+	return nil, false
 }
 
 func (o *opHistory) FindFwd(isNewSearch bool, rs []rune, start int) (int, *list.Element) {
 	for elem := o.current; elem != nil; elem = elem.Next() {
-		item := o.showItem(elem.Value)
+		item := o.showItem(elem)
 		if isNewSearch {
 			start -= len(rs)
 			if start < 0 {
@@ -192,9 +283,12 @@ func (o *opHistory) FindFwd(isNewSearch bool, rs []rune, start int) (int, *list.
 	return -1, nil
 }
 
-func (o *opHistory) showItem(obj interface{}) []rune {
-	item := obj.(*hisItem)
-	if item.Version == o.historyVer {
+// showItem returns the entry of elem as shown, with its edits if they're
+// kept: always for the line being typed, for the others only with
+// Config.PreserveHistoryEdits.
+func (o *opHistory) showItem(elem *list.Element) []rune {
+	item := elem.Value.(*hisItem)
+	if item.Version == o.historyVer && (o.cfg.PreserveHistoryEdits || elem == o.history.Back()) {
 		return item.Tmp
 	}
 	return item.Source
@@ -208,8 +302,11 @@ func (o *opHistory) Prev() []rune {
 	if current == nil {
 		return nil
 	}
+	if o.cfg.SessionOnlyHistoryNavigation && current == o.sessionStart {
+		return nil
+	}
 	o.current = current
-	return runes.Copy(o.showItem(current.Value))
+	return runes.Copy(o.showItem(current))
 }
 
 func (o *opHistory) Next() ([]rune, bool) {
@@ -222,7 +319,16 @@ func (o *opHistory) Next() ([]rune, bool) {
 	}
 
 	o.current = current
-	return runes.Copy(o.showItem(current.Value)), true
+	return runes.Copy(o.showItem(current)), true
+}
+
+// currentIndex returns the position of the current entry, 0 being the oldest.
+func (o *opHistory) currentIndex() int {
+	idx := 0
+	for elem := o.current; elem != nil; elem = elem.Prev() {
+		idx++
+	}
+	return idx - 1
 }
 
 // Disable the current history
@@ -312,8 +418,12 @@ func (o *opHistory) Update(s []rune, commit bool) (err error) {
 	if commit {
 		r.Source = s
 		if o.fd != nil {
-			// just report the error
+			// appended unbuffered in one write and flushed to the disk, the
+			// previous lines are never at risk; just report the error
 			_, err = o.fd.Write([]byte(string(r.Source) + "\n"))
+			if err == nil {
+				err = o.fd.Sync()
+			}
 		}
 	} else {
 		r.Tmp = append(r.Tmp[:0], s...)
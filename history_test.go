@@ -0,0 +1,306 @@
+package readline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type sliceIterator struct {
+	lines []string
+	calls int
+}
+
+func (s *sliceIterator) Prev() (string, bool) {
+	s.calls++
+	if len(s.lines) == 0 {
+		return "", false
+	}
+	line := s.lines[len(s.lines)-1]
+	s.lines = s.lines[:len(s.lines)-1]
+	return line, true
+}
+
+func TestHistorySearchIterator(t *testing.T) {
+	it := &sliceIterator{lines: []string{"git status", "ls", "git commit", "make"}}
+	rl, w := newTestInstance(t, &Config{
+		FuncHistoryIterator: func() HistoryIterator { return it },
+	})
+	go w.Write([]byte("\x12git\x12\r"))
+
+	expectLine(t, rl, "git status")
+	if it.calls != 4 {
+		t.Fatalf("unexpected calls %d", it.calls)
+	}
+}
+
+func TestHistorySearchBackward(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	for _, line := range []string{"git status", "ls", "git commit", "make"} {
+		rl.SaveHistory(line)
+	}
+	go w.Write([]byte("\x12git\x12\r"))
+	expectLine(t, rl, "git status")
+}
+
+func TestHistoryIterator(t *testing.T) {
+	cfg := &Config{Stdin: ioutil.NopCloser(bytes.NewReader(nil))}
+	cfg.Init()
+	h := newOpHistory(cfg)
+	h.Push(nil)
+	for _, line := range []string{"git status", "ls", "git commit"} {
+		h.New([]rune(line))
+	}
+
+	var lines []string
+	it := h.iterator(h.history.Back())
+	for line, ok := it.Prev(); ok; line, ok = it.Prev() {
+		lines = append(lines, line)
+	}
+	if strings.Join(lines, "|") != "git commit|ls|git status" {
+		t.Fatalf("unexpected history %q", lines)
+	}
+}
+
+func TestHistorySearchFold(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{HistorySearchFold: true})
+	for _, line := range []string{"GIT STATUS", "ls", "Make BUILD"} {
+		rl.SaveHistory(line)
+	}
+	go w.Write([]byte("\x12git\r"))
+	expectLine(t, rl, "GIT STATUS")
+}
+
+func TestHistoryKeepsEdits(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{PreserveHistoryEdits: true})
+	for _, line := range []string{"one", "two"} {
+		rl.SaveHistory(line)
+	}
+	go func() {
+		// edit "one", go down to "two" and back up
+		w.Write([]byte("\x10\x10!\x0e\x10\r"))
+		// the edit is dropped once the line is accepted
+		w.Write([]byte("\x10\x10\x10\r"))
+	}()
+	expectLine(t, rl, "one!")
+	expectLine(t, rl, "one")
+}
+
+func TestHistoryDropsEdits(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	for _, line := range []string{"one", "two"} {
+		rl.SaveHistory(line)
+	}
+	// the edit of "one" is dropped going down to "two", the line being
+	// typed is kept
+	go w.Write([]byte("!"))
+	expectLine(t, rl, "one")
+	go w.Write([]byte("new"))
+	expectLine(t, rl, "new")
+}
+
+func TestOnHistoryMove(t *testing.T) {
+	var moves []string
+	rl, w := newTestInstance(t, &Config{
+		OnHistoryMove: func(line string, index int) {
+			moves = append(moves, fmt.Sprintf("%d:%s", index, line))
+		},
+	})
+	for _, line := range []string{"one", "two"} {
+		rl.SaveHistory(line)
+	}
+	go w.Write([]byte("\x10\x10\x0e\r"))
+	expectLine(t, rl, "two")
+
+	if strings.Join(moves, "|") != "1:two|0:one|1:two" {
+		t.Fatalf("unexpected moves %q", moves)
+	}
+}
+
+func TestSearchPrompt(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		SearchPrompt:   "suche: [%s]",
+	})
+	rl.SaveHistory("hello")
+	go w.Write([]byte("\x12he\r"))
+	expectLine(t, rl, "hello")
+
+	if !strings.Contains(out.String(), "suche: [he\033[4m \033[0m]") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+}
+
+// fuzzyMatch matches the entries holding the runes of query in order.
+func fuzzyMatch(entry, query string) (bool, [][2]int) {
+	var ranges [][2]int
+	q := []rune(query)
+	for i, r := range []rune(entry) {
+		if len(q) > 0 && r == q[0] {
+			ranges = append(ranges, [2]int{i, i + 1})
+			q = q[1:]
+		}
+	}
+	return len(q) == 0, ranges
+}
+
+func TestHistoryMatcher(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+		HistoryMatcher: fuzzyMatch,
+	})
+	for _, line := range []string{"git commit", "go test", "grep x"} {
+		rl.SaveHistory(line)
+	}
+	go w.Write([]byte("\x12gt\r"))
+	expectLine(t, rl, "go test")
+	if !strings.Contains(out.String(), "\033[4mg\033[0mo \033[4mt\033[0m") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// Ctrl-R again goes on with the older entries
+	go w.Write([]byte("\x12gt\x12\r"))
+	expectLine(t, rl, "git commit")
+
+	go w.Write([]byte("\x12gz\x07\r"))
+	expectLine(t, rl, "")
+}
+
+func TestSearchFailing(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+	})
+	for _, line := range []string{"help", "hello"} {
+		rl.SaveHistory(line)
+	}
+	// no more matches keeps "help", then refine to "hel"
+	go w.Write([]byte("\x12hel\x12\x12x\x7f\r"))
+	expectLine(t, rl, "help")
+	if !strings.Contains(out.String(), "failing bck-i-search: helx") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// Ctrl-G reverts to the line before the search
+	go w.Write([]byte("abc\x12hel\x12\x12\x07\r"))
+	expectLine(t, rl, "abc")
+}
+
+func TestHistorySearchPrefix(t *testing.T) {
+	cfg := &Config{}
+	err := parseInputrc(strings.NewReader("\"\\e[A\": history-search-backward\n\"\\e[B\": history-search-forward\n"), cfg, func(line int, format string, args ...interface{}) {
+		t.Fatalf("unexpected warning on line %d", line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, w := newTestInstance(t, cfg)
+	for _, line := range []string{"git status", "ls", "git log"} {
+		rl.SaveHistory(line)
+	}
+	go w.Write([]byte("git\033[A\r"))
+	expectLine(t, rl, "git log")
+	// up to "git status", back to "git log", the cursor stays after the
+	// prefix
+	go w.Write([]byte("git\033[A\033[A\033[BX\r"))
+	expectLine(t, rl, "gitX log")
+	// no match keeps the line
+	go w.Write([]byte("cd\033[A\r"))
+	expectLine(t, rl, "cd")
+}
+
+func TestSessionOnlyHistoryNavigation(t *testing.T) {
+	f, err := ioutil.TempFile("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("old one\nold two\n")
+	f.Close()
+
+	rl, w := newTestInstance(t, &Config{
+		HistoryFile:                  f.Name(),
+		SessionOnlyHistoryNavigation: true,
+	})
+	rl.SaveHistory("new")
+
+	go w.Write([]byte("\x10\x10\r"))
+	expectLine(t, rl, "new")
+	go w.Write([]byte("\x12old\r"))
+	expectLine(t, rl, "old two")
+}
+
+func TestHistoryFilePerm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	created := filepath.Join(dir, "created")
+	newTestInstance(t, &Config{HistoryFile: created})
+	if fi, err := os.Stat(created); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode %v, %v", fi.Mode(), err)
+	}
+
+	// rewritten as there are more lines than HistoryLimit
+	trimmed := filepath.Join(dir, "trimmed")
+	if err := ioutil.WriteFile(trimmed, []byte("a\nb\nc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newTestInstance(t, &Config{HistoryFile: trimmed, HistoryLimit: 2, HistoryFilePerm: 0640})
+	if fi, err := os.Stat(trimmed); err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("unexpected mode %v, %v", fi.Mode(), err)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history")
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write failing halfway leaves the file untouched
+	_, err = writeFileAtomic(path, 0600, func(w io.Writer) error {
+		io.WriteString(w, "new\n")
+		return errors.New("disk full")
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "old\n" {
+		t.Fatalf("unexpected content %q", content)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("the temporary file should be removed: %v", err)
+	}
+
+	fd, err := writeFileAtomic(path, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new\n")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte("appended\n"))
+	fd.Close()
+	if content, _ := ioutil.ReadFile(path); string(content) != "new\nappended\n" {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
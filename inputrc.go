@@ -0,0 +1,269 @@
+package readline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// loadInputrc applies the InputrcPath to c, a missing file is ignored.
+func (c *Config) loadInputrc() error {
+	path := c.InputrcPath
+	if strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	warn := c.InputrcWarningWriter
+	if warn == nil {
+		warn = c.Stderr
+	}
+	if warn == nil {
+		warn = Stderr
+	}
+	return parseInputrc(f, c, func(line int, format string, args ...interface{}) {
+		fmt.Fprintf(warn, "%s:%d: %s\n", path, line, fmt.Sprintf(format, args...))
+	})
+}
+
+// parseInputrc applies the subset of the inputrc syntax understood to c:
+// the variables below set by `set name value` and the keys bound to the
+// functions of inputrcFunctions by `"keyseq": function`. The rest is
+// reported to warn and ignored.
+func parseInputrc(r io.Reader, c *Config, warn func(line int, format string, args ...interface{})) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#':
+		case line[0] == '$':
+			warn(n, "unsupported directive %q", line)
+		case strings.HasPrefix(line, "set ") || strings.HasPrefix(line, "set\t"):
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				warn(n, "missing value in %q", line)
+				continue
+			}
+			if err := c.setInputrcVariable(fields[1], fields[2]); err != nil {
+				warn(n, "%v", err)
+			}
+		case line[0] == '"':
+			seq, rest, ok := readInputrcKeyseq(line)
+			if !ok {
+				warn(n, "malformed key sequence in %q", line)
+				continue
+			}
+			rest = strings.TrimSpace(rest)
+			if !strings.HasPrefix(rest, ":") {
+				warn(n, "missing ':' in %q", line)
+				continue
+			}
+			if err := c.bindInputrcKey(seq, strings.TrimSpace(rest[1:])); err != nil {
+				warn(n, "%v", err)
+			}
+		default:
+			warn(n, "unsupported line %q", line)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *Config) setInputrcVariable(name, value string) error {
+	on := strings.EqualFold(value, "on") || value == "1"
+	switch strings.ToLower(name) {
+	case "editing-mode":
+		switch value {
+		case "vi":
+			c.VimMode = true
+		case "emacs":
+			c.VimMode = false
+		default:
+			return fmt.Errorf("unknown editing-mode %q", value)
+		}
+	case "completion-ignore-case":
+		c.CompletionIgnoreCase = on
+	case "history-size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid history-size %q", value)
+		}
+		// unlike HistoryLimit, a negative size means no limit
+		switch {
+		case size < 0:
+			size = math.MaxInt32
+		case size == 0:
+			size = -1
+		}
+		c.HistoryLimit = size
+	default:
+		return fmt.Errorf("unsupported variable %q", name)
+	}
+	return nil
+}
+
+// inputrcFunctions gives the fields of the Config binding a key to the
+// readline functions which can be bound.
+var inputrcFunctions = map[string]func(c *Config) *rune{
+	"complete":                   func(c *Config) *rune { return &c.CompleteKey },
+	"kill-whole-line":            func(c *Config) *rune { return &c.KillWholeLineKey },
+	"delete-to-matching-bracket": func(c *Config) *rune { return &c.DeleteToMatchingBracketKey },
+	"insert-datetime":            func(c *Config) *rune { return &c.InsertDateTimeKey },
+}
+
+// inputrcKeys gives the keys of the readline functions which are bound
+// through the KeyMap of the editing mode.
+var inputrcKeys = map[string]rune{
+	"accept-line":             CharEnter,
+	"backward-char":           CharBackward,
+	"backward-delete-char":    CharBackspace,
+	"backward-kill-word":      MetaBackspace,
+	"backward-word":           MetaBackward,
+	"beginning-of-line":       CharLineStart,
+	"clear-screen":            CharCtrlL,
+	"delete-char":             CharForwardDelete,
+	"end-of-line":             CharLineEnd,
+	"forward-char":            CharForward,
+	"forward-search-history":  CharFwdSearch,
+	"forward-word":            MetaForward,
+	"history-search-backward": CharHistorySearchBackward,
+	"history-search-forward":  CharHistorySearchForward,
+	"kill-line":               CharKill,
+	"kill-word":               MetaDelete,
+	"next-history":            CharNext,
+	"previous-history":        CharPrev,
+	"reverse-search-history":  CharBckSearch,
+	"transpose-chars":         CharTranspose,
+	"unix-line-discard":       CharCtrlU,
+	"unix-word-rubout":        CharCtrlW,
+	"yank":                    CharCtrlY,
+}
+
+func (c *Config) bindInputrcKey(seq []rune, function string) error {
+	field, isField := inputrcFunctions[function]
+	to, isKey := inputrcKeys[function]
+	if !isField && !isKey {
+		return fmt.Errorf("unsupported function %q", function)
+	}
+	key, ok := decodeKeyseq(seq)
+	if !ok {
+		return fmt.Errorf("unsupported key sequence %q for %s", string(seq), function)
+	}
+	if isField {
+		*field(c) = key
+		return nil
+	}
+	// the keymap of the editing mode set so far, the insert one for vi
+	keyMap := &c.EmacsKeyMap
+	if c.VimMode {
+		keyMap = &c.VimInsertKeyMap
+	}
+	if *keyMap == nil {
+		*keyMap = KeyMap{}
+	}
+	(*keyMap)[key] = to
+	return nil
+}
+
+// readInputrcKeyseq reads the quoted key sequence line starts with,
+// resolving the escapes (\C-x, \M-x, \e...), and returns the rest of line.
+func readInputrcKeyseq(line string) (seq []rune, rest string, ok bool) {
+	rs := []rune(line)
+	for i := 1; i < len(rs); i++ {
+		switch rs[i] {
+		case '"':
+			return seq, string(rs[i+1:]), true
+		case '\\':
+		default:
+			seq = append(seq, rs[i])
+			continue
+		}
+		i++
+		if i >= len(rs) {
+			break
+		}
+		switch e := rs[i]; e {
+		case 'C', 'M':
+			if i+2 >= len(rs) || rs[i+1] != '-' {
+				return nil, "", false
+			}
+			i += 2
+			r := rs[i]
+			if r == '\\' && i+1 < len(rs) {
+				i++
+				r = rs[i]
+			}
+			if e == 'C' {
+				if r == '?' {
+					r = CharBackspace
+				} else {
+					r &= 0x1f
+				}
+				seq = append(seq, r)
+			} else {
+				seq = append(seq, CharEsc, r)
+			}
+		case 'e':
+			seq = append(seq, CharEsc)
+		case 'a':
+			seq = append(seq, CharBell)
+		case 'b':
+			seq = append(seq, CharCtrlH)
+		case 'd':
+			seq = append(seq, CharBackspace)
+		case 'n':
+			seq = append(seq, '\n')
+		case 'r':
+			seq = append(seq, '\r')
+		case 't':
+			seq = append(seq, '\t')
+		default:
+			seq = append(seq, e)
+		}
+	}
+	return nil, "", false
+}
+
+// decodeKeyseq returns the key the terminal reads from seq, it fails
+// unless seq is a single key.
+func decodeKeyseq(seq []rune) (rune, bool) {
+	if len(seq) == 0 {
+		return 0, false
+	}
+	if seq[0] != CharEsc || len(seq) == 1 {
+		return seq[0], len(seq) == 1
+	}
+	reader := strings.NewReader(string(seq[2:]))
+	var r rune
+	switch seq[1] {
+	case CharEscapeEx:
+		if len(seq) == 2 {
+			return 0, false
+		}
+		next, _, _ := reader.ReadRune()
+		r = escapeExKey(readEscKey(next, reader))
+	case CharO:
+		if len(seq) == 2 {
+			return 0, false
+		}
+		next, _, _ := reader.ReadRune()
+		r = escapeSS3Key(readEscKey(next, reader))
+	default:
+		r = escapeKey(seq[1], reader)
+	}
+	return r, r != 0 && reader.Len() == 0
+}
@@ -0,0 +1,112 @@
+package readline
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseInputrc(t *testing.T) {
+	inputrc := `# my settings
+set editing-mode vi
+set completion-ignore-case on
+set history-size 100
+"\C-u": kill-whole-line
+"\e[Z": complete
+"\M-%": delete-to-matching-bracket
+"\e[A": history-search-backward
+$if Bash
+set bell-style none
+`
+	cfg := &Config{}
+	var warnings []int
+	err := parseInputrc(strings.NewReader(inputrc), cfg, func(line int, format string, args ...interface{}) {
+		warnings = append(warnings, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.VimMode || !cfg.CompletionIgnoreCase || cfg.HistoryLimit != 100 {
+		t.Fatalf("unexpected settings %+v", cfg)
+	}
+	if cfg.KillWholeLineKey != CharCtrlU {
+		t.Fatalf("unexpected KillWholeLineKey %q", cfg.KillWholeLineKey)
+	}
+	if cfg.CompleteKey != 0 {
+		// Shift-Tab isn't decoded to a key
+		t.Fatalf("unexpected CompleteKey %q", cfg.CompleteKey)
+	}
+	if cfg.DeleteToMatchingBracketKey != MetaKey('%') {
+		t.Fatalf("unexpected DeleteToMatchingBracketKey %q", cfg.DeleteToMatchingBracketKey)
+	}
+	// bound in the keymap of vi insert mode
+	if to := cfg.VimInsertKeyMap[CharPrev]; to != CharHistorySearchBackward {
+		t.Fatalf("unexpected binding of Up %q", to)
+	}
+	if fmt.Sprint(warnings) != "[6 9 10]" {
+		t.Fatalf("unexpected warnings on lines %v", warnings)
+	}
+}
+
+func TestInputrcHistorySize(t *testing.T) {
+	ret := []struct {
+		value string
+		limit int
+	}{
+		{"100", 100},
+		{"0", -1},
+		{"-1", math.MaxInt32},
+	}
+	for _, r := range ret {
+		cfg := &Config{}
+		if err := cfg.setInputrcVariable("history-size", r.value); err != nil || cfg.HistoryLimit != r.limit {
+			t.Fatalf("history-size %s: unexpected %v, HistoryLimit %d", r.value, err, cfg.HistoryLimit)
+		}
+	}
+}
+
+func TestConfigInputrcPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inputrc")
+	if err := ioutil.WriteFile(path, []byte("\"\\C-x\": complete\nset mark-directories on\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := bytes.NewBuffer(nil)
+	stdin := ioutil.NopCloser(bytes.NewReader(nil))
+	cfg := &Config{InputrcPath: path, InputrcWarningWriter: warnings, Stdin: stdin}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CompleteKey != CharCtrlX {
+		t.Fatalf("unexpected CompleteKey %q", cfg.CompleteKey)
+	}
+	if expected := path + ":2: unsupported variable \"mark-directories\"\n"; warnings.String() != expected {
+		t.Fatalf("unexpected warnings %q", warnings.String())
+	}
+
+	// the warnings go to the Stderr of the Config by default
+	stderr := bytes.NewBuffer(nil)
+	cfg = &Config{InputrcPath: path, Stdin: stdin, Stderr: stderr}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if stderr.String() != warnings.String() {
+		t.Fatalf("unexpected warnings %q", stderr.String())
+	}
+
+	// a missing file is ignored
+	cfg = &Config{InputrcPath: filepath.Join(dir, "missing"), Stdin: stdin}
+	if err := cfg.Init(); err != nil || cfg.CompleteKey != CharTab {
+		t.Fatalf("unexpected Init %v, CompleteKey %q", err, cfg.CompleteKey)
+	}
+}
@@ -0,0 +1,88 @@
+package readline
+
+// opMacro records the keys between Ctrl-X ( and Ctrl-X ) as a keyboard
+// macro, which Ctrl-X e replays, as GNU readline does.
+type opMacro struct {
+	o *Operation
+	// the keys read since Ctrl-X (, nil if not recording
+	recording []rune
+	// the last macro recorded
+	macro []rune
+	// the keys of the macro left to replay, they're read before the
+	// terminal's
+	replaying []rune
+}
+
+func newOpMacro(o *Operation) *opMacro {
+	return &opMacro{o: o}
+}
+
+func (o *opMacro) IsRecordingMacro() bool {
+	return o.recording != nil
+}
+
+// StartMacro starts recording the keys, it fails if a macro is being
+// recorded or replayed already.
+func (o *opMacro) StartMacro() bool {
+	if o.IsRecordingMacro() || len(o.replaying) > 0 {
+		return false
+	}
+	o.recording = []rune{}
+	return true
+}
+
+// EndMacro stops recording, the keys read since StartMacro but the last n
+// (those which ended it) become the macro.
+func (o *opMacro) EndMacro(n int) bool {
+	if !o.IsRecordingMacro() {
+		return false
+	}
+	keys := o.recording
+	if n > len(keys) {
+		n = len(keys)
+	}
+	o.macro = keys[:len(keys)-n]
+	o.recording = nil
+	return true
+}
+
+// PlayMacro queues the keys of the last macro to be read next, it fails
+// while recording or if there's no macro.
+func (o *opMacro) PlayMacro() bool {
+	if o.IsRecordingMacro() || len(o.macro) == 0 {
+		return false
+	}
+	o.replaying = append(o.replaying, o.macro...)
+	return true
+}
+
+// nextMacroKey returns the next key of the macro being replayed, if any.
+func (o *opMacro) nextMacroKey() (rune, bool) {
+	if len(o.replaying) == 0 {
+		return 0, false
+	}
+	r := o.replaying[0]
+	o.replaying = o.replaying[1:]
+	return r, true
+}
+
+func (o *opMacro) recordKey(r rune) {
+	if o.IsRecordingMacro() {
+		o.recording = append(o.recording, r)
+	}
+}
+
+// handleMacroKey runs the Ctrl-X command given by key, it returns false
+// if key isn't one or the command fails.
+func (o *opMacro) handleMacroKey(key rune) bool {
+	switch key {
+	case '(':
+		return o.StartMacro()
+	case ')':
+		// Ctrl-X ) isn't part of the macro
+		return o.EndMacro(2)
+	case 'e':
+		return o.PlayMacro()
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package readline
+
+import (
+	"testing"
+)
+
+func TestKeyboardMacro(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	// record "ab" and a move back, then replay it where it ended
+	go w.Write([]byte("\x18(ab\x02\x18)\x18e\r"))
+	expectLine(t, rl, "aabb")
+
+	// the macro is kept for the next lines
+	go w.Write([]byte("x\x18e\r"))
+	expectLine(t, rl, "xab")
+
+	// no nested recording, the second Ctrl-X ( only rings the bell
+	go w.Write([]byte("\x18(x\x18(y\x18)\x18e\r"))
+	expectLine(t, rl, "xyxy")
+
+	// unknown Ctrl-X commands do nothing
+	go w.Write([]byte("a\x18zb\r"))
+	expectLine(t, rl, "ab")
+}
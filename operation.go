@@ -1,9 +1,17 @@
 package readline
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 )
 
 var (
@@ -25,19 +33,100 @@ type Operation struct {
 	buf     *RuneBuffer
 	outchan chan []rune
 	errchan chan error
-	w       io.Writer
+	// acceptChan asks the ioloop to accept the line as if Enter was pressed
+	acceptChan chan struct{}
+	// resetChan asks the ioloop to leave the completion and the search
+	resetChan chan struct{}
+	// resizeChan asks the ioloop to lay the candidates out again for the
+	// new width of the terminal
+	resizeChan chan struct{}
+	// applyChan tells the ioloop that ApplyCandidate queued candidates
+	applyChan chan struct{}
+	applyM    sync.Mutex
+	applied   []Candidate
+	// cancelChan tells the ioloop to drop the next line accepted, the
+	// Readline it was for gave up on its context
+	cancelChan chan struct{}
+	w          io.Writer
+
+	// the candidates still to come from a StreamingCompleter
+	stream <-chan Candidate
+
+	// the ticker for OnTick, only used by the ioloop
+	tick         <-chan time.Time
+	stopTick     func()
+	tickInterval time.Duration
+	// the CompletionTimeout countdown, only used by the ioloop
+	completeTimer     <-chan time.Time
+	stopCompleteTimer func()
+	// flashChan asks the ioloop to show a FlashMessage, which is cleared
+	// once flashTimer fires
+	flashChan      chan flashMessage
+	flashTimer     <-chan time.Time
+	stopFlashTimer func()
+
+	// set by SetPromptStatus(false), for Config.FuncStatusPrompt
+	promptFailed int32
+	// set while a Readline waits for its line, AcceptLine is dropped
+	// otherwise
+	waitingLine int32
 
 	history *opHistory
 	*opSearch
 	*opCompleter
 	*opPassword
 	*opVim
+	*opSnippet
+	*opMacro
 }
 
 func (o *Operation) SetBuffer(what string) {
 	o.buf.Set([]rune(what))
 }
 
+func (o *Operation) SetBufferWithCursor(what string, pos int) {
+	rs := []rune(what)
+	if pos < 0 {
+		pos = 0
+	} else if pos > len(rs) {
+		pos = len(rs)
+	}
+	o.buf.SetWithIdx(pos, rs)
+}
+
+func (o *Operation) GetCutBuffer() string {
+	return string(o.buf.KillBuffer())
+}
+
+func (o *Operation) SetCutBuffer(text string) {
+	o.buf.SetKillBuffer([]rune(text))
+}
+
+// Insert writes text at the cursor position and moves the cursor after it.
+func (o *Operation) Insert(text string) {
+	o.buf.WriteString(text)
+}
+
+func (o *Operation) MoveCursor(delta int) {
+	o.buf.MoveCursor(delta)
+}
+
+func (o *Operation) MoveToLineStart() {
+	o.buf.MoveToLineStart()
+}
+
+func (o *Operation) MoveToLineEnd() {
+	o.buf.MoveToLineEnd()
+}
+
+func (o *Operation) MoveWordLeft() {
+	o.buf.MoveToPrevWord()
+}
+
+func (o *Operation) MoveWordRight() {
+	o.buf.MoveToNextWord()
+}
+
 type wrapWriter struct {
 	r      *Operation
 	t      *Terminal
@@ -67,23 +156,35 @@ func (w *wrapWriter) Write(b []byte) (int, error) {
 }
 
 func NewOperation(t *Terminal, cfg *Config) *Operation {
-	width := cfg.FuncGetWidth()
+	width := cfg.getWidth()
 	op := &Operation{
-		t:       t,
-		buf:     NewRuneBuffer(t, cfg.Prompt, cfg, width),
-		outchan: make(chan []rune),
-		errchan: make(chan error, 1),
+		t:          t,
+		buf:        NewRuneBuffer(t, cfg.Prompt, cfg, width),
+		outchan:    make(chan []rune),
+		errchan:    make(chan error, 1),
+		acceptChan: make(chan struct{}, 1),
+		resetChan:  make(chan struct{}, 1),
+		resizeChan: make(chan struct{}, 1),
+		applyChan:  make(chan struct{}, 1),
+		cancelChan: make(chan struct{}, 1),
+		flashChan:  make(chan flashMessage, 1),
 	}
 	op.w = op.buf.w
 	op.SetConfig(cfg)
 	op.opVim = newVimMode(op)
 	op.opCompleter = newOpCompleter(op.buf.w, op, width)
 	op.opPassword = newOpPassword(op)
+	op.opSnippet = newOpSnippet(op)
+	op.opMacro = newOpMacro(op)
 	op.cfg.FuncOnWidthChanged(func() {
-		newWidth := cfg.FuncGetWidth()
+		newWidth := cfg.getWidth()
 		op.opCompleter.OnWidthChange(newWidth)
 		op.opSearch.OnWidthChange(newWidth)
 		op.buf.OnWidthChange(newWidth)
+		select {
+		case op.resizeChan <- struct{}{}:
+		default:
+		}
 	})
 	go op.ioloop()
 	return op
@@ -93,6 +194,16 @@ func (o *Operation) SetPrompt(s string) {
 	o.buf.SetPrompt(s)
 }
 
+// SetPromptStatus sets the status passed to Config.FuncStatusPrompt for
+// the prompt of the next lines.
+func (o *Operation) SetPromptStatus(ok bool) {
+	var failed int32
+	if !ok {
+		failed = 1
+	}
+	atomic.StoreInt32(&o.promptFailed, failed)
+}
+
 func (o *Operation) SetMaskRune(r rune) {
 	o.buf.SetMask(r)
 }
@@ -108,7 +219,8 @@ func (o *Operation) ioloop() {
 	for {
 		keepInSearchMode := false
 		keepInCompleteMode := false
-		r := o.t.ReadRune()
+		o.resetCompleteTimer()
+		r := o.readRune()
 
 		if o.GetConfig().FuncFilterInputRune != nil {
 			var process bool
@@ -120,6 +232,14 @@ func (o *Operation) ioloop() {
 			}
 		}
 
+		if to, ok := o.keyMap()[r]; ok && r != 0 {
+			if to == 0 {
+				o.t.KickRead()
+				continue
+			}
+			r = to
+		}
+
 		if r == 0 { // io.EOF
 			if o.buf.Len() == 0 {
 				o.buf.Clean()
@@ -136,6 +256,16 @@ func (o *Operation) ioloop() {
 		}
 		isUpdateHistory := true
 
+		if col, row, ok := isMouseClick(r); ok {
+			// only the clicks on the candidates do something
+			if o.IsInCompleteMode() && o.HandleClick(col, row) {
+				o.buf.Refresh(nil)
+				o.CompleteRefresh()
+				o.history.Update(o.buf.Runes(), false)
+			}
+			continue
+		}
+
 		if o.IsInCompleteSelectMode() {
 			keepInCompleteMode = o.HandleCompleteSelect(r)
 			if keepInCompleteMode {
@@ -143,47 +273,77 @@ func (o *Operation) ioloop() {
 			}
 
 			o.buf.Refresh(nil)
-			switch r {
-			case CharEnter, CharCtrlJ:
+			switch {
+			case o.isCompletionAcceptKey(r):
 				o.history.Update(o.buf.Runes(), false)
+				if o.IsInCompleteMode() {
+					// reopened for the new line
+					o.CompleteRefresh()
+				}
 				fallthrough
-			case CharInterrupt:
+			case r == CharInterrupt:
 				o.t.KickRead()
-				fallthrough
-			case CharBell:
+				continue
+			case r == CharBell:
+				o.abort()
 				continue
 			}
 		}
 
 		if o.IsEnableVimMode() {
-			r = o.HandleVim(r, o.t.ReadRune)
+			r = o.HandleVim(r, o.readRune)
 			if r == 0 {
 				continue
 			}
 		}
 
-		switch r {
-		case CharBell:
-			if o.IsSearchMode() {
-				o.ExitSearchMode(true)
-				o.buf.Refresh(nil)
+		if r == CharBackspace && o.GetConfig().BackspaceIsDelete {
+			r = CharForwardDelete
+		}
+
+		if key := o.GetConfig().CompleteAndAcceptKey; key != 0 && r == key && !o.IsSearchMode() {
+			if o.completeUnique() {
+				r = CharEnter
+			} else {
+				r = o.GetConfig().CompleteKey
 			}
-			if o.IsInCompleteMode() {
-				o.ExitCompleteMode(true)
-				o.buf.Refresh(nil)
+		}
+
+		switch r {
+		case o.GetConfig().CompleteKey:
+			if o.IsInSnippetMode() {
+				o.NextTabstop()
+				break
 			}
-		case CharTab:
 			if o.GetConfig().AutoComplete == nil {
 				o.t.Bell()
 				break
 			}
+			if _, ok := o.GetConfig().AutoComplete.(*TabCompleter); ok && o.GetConfig().TabInsertsSpaces {
+				o.insertTabSpaces()
+				break
+			}
 			if o.OnComplete() {
 				keepInCompleteMode = true
 			} else {
 				o.t.Bell()
 				break
 			}
-
+		case o.GetConfig().KillWholeLineKey:
+			o.buf.KillWholeLine()
+		case o.GetConfig().DeleteToMatchingBracketKey:
+			if !o.buf.DeleteToMatchingBracket() {
+				o.t.Bell()
+			}
+		case o.GetConfig().InsertDateTimeKey:
+			cfg := o.GetConfig()
+			o.buf.WriteString(cfg.funcNow().Format(cfg.DateTimeFormat))
+		case CharCtrlX:
+			if !o.handleMacroKey(o.readRune()) {
+				o.t.Bell()
+			}
+		case CharBell:
+			o.abort()
 		case CharBckSearch:
 			if !o.SearchMode(S_DIR_BCK) {
 				o.t.Bell()
@@ -210,9 +370,9 @@ func (o *Operation) ioloop() {
 		case MetaDelete:
 			o.buf.DeleteWord()
 		case CharLineStart:
-			o.buf.MoveToLineStart()
+			o.buf.MoveToCurrentLineStart()
 		case CharLineEnd:
-			o.buf.MoveToLineEnd()
+			o.buf.MoveToCurrentLineEnd()
 		case CharBackspace, CharCtrlH:
 			if o.IsSearchMode() {
 				o.SearchBackspace()
@@ -224,10 +384,18 @@ func (o *Operation) ioloop() {
 				o.t.Bell()
 				break
 			}
-			o.buf.Backspace()
+			if o.GetConfig().AutoCloseBrackets && o.inEmptyPair() {
+				o.buf.DeletePair()
+			} else if indent := o.GetConfig().SmartBackspaceIndent; indent > 0 {
+				o.buf.BackspaceIndent(indent)
+			} else {
+				o.buf.Backspace()
+			}
 			if o.IsInCompleteMode() {
 				o.OnComplete()
 			}
+		case CharEsc:
+			// a lone ESC outside of vim mode, nothing to do
 		case CharCtrlZ:
 			o.buf.Clean()
 			o.t.SleepToResume()
@@ -235,8 +403,10 @@ func (o *Operation) ioloop() {
 		case CharCtrlL:
 			ClearScreen(o.w)
 			o.Refresh()
-		case MetaBackspace, CharCtrlW:
+		case MetaBackspace:
 			o.buf.BackEscapeWord()
+		case CharCtrlW:
+			o.buf.UnixWordRubout()
 		case CharCtrlY:
 			o.buf.Yank()
 		case CharEnter, CharCtrlJ:
@@ -245,7 +415,10 @@ func (o *Operation) ioloop() {
 			}
 			o.buf.MoveToLineEnd()
 			var data []rune
-			if !o.GetConfig().UniqueEditLine {
+			if o.GetConfig().NoNewlineOnAccept && !o.GetConfig().UniqueEditLine {
+				// the cursor stays at the end of the line
+				data = o.buf.Reset()
+			} else if !o.GetConfig().UniqueEditLine {
 				o.buf.WriteRune('\n')
 				data = o.buf.Reset()
 				data = data[:len(data)-1] // trim \n
@@ -253,31 +426,66 @@ func (o *Operation) ioloop() {
 				o.buf.Clean()
 				data = o.buf.Reset()
 			}
-			o.outchan <- data
-			if !o.GetConfig().DisableAutoSaveHistory {
+			if o.GetConfig().TrimTrailingSpace && !o.IsInPasswordMode() {
+				data = runes.TrimSpaceRight(data)
+			}
+			if len(data) == 0 && o.GetConfig().IgnoreEmptyLine && !o.IsInPasswordMode() {
+				// prompt again on the next line
+				o.buf.Refresh(nil)
+				o.t.KickRead()
+				break
+			}
+			o.writeTranscript(data)
+			if o.GetConfig().DisableAutoSaveHistory {
+				// drop the edits made while typing, the line will only be
+				// recorded if the caller saves it explicitly
+				o.history.Revert()
+				isUpdateHistory = false
+				o.sendLine(data)
+			} else {
+				o.sendLine(data)
 				// ignore IO error
 				_ = o.history.New(data)
-			} else {
-				isUpdateHistory = false
 			}
 		case CharBackward:
 			o.buf.MoveBackward()
 		case CharForward:
 			o.buf.MoveForward()
 		case CharPrev:
+			if o.buf.MoveToPrevLine() {
+				break
+			}
 			buf := o.history.Prev()
 			if buf != nil {
 				o.buf.Set(buf)
+				o.onHistoryMove(buf)
 			} else {
 				o.t.Bell()
 			}
 		case CharNext:
+			if o.buf.MoveToNextLine() {
+				break
+			}
 			buf, ok := o.history.Next()
 			if ok {
 				o.buf.Set(buf)
+				o.onHistoryMove(buf)
+			} else {
+				o.t.Bell()
+			}
+		case CharHistorySearchBackward, CharHistorySearchForward:
+			idx := o.buf.Pos()
+			buf, ok := o.history.FindPrefix(o.buf.Runes()[:idx], r == CharHistorySearchBackward)
+			if ok {
+				o.buf.SetWithIdx(idx, buf)
+				o.onHistoryMove(buf)
 			} else {
 				o.t.Bell()
 			}
+		case CharForwardDelete:
+			if !o.buf.Delete() {
+				o.t.Bell()
+			}
 		case CharDelete:
 			if o.buf.Len() > 0 || !o.IsNormalMode() {
 				o.t.KickRead()
@@ -324,12 +532,24 @@ func (o *Operation) ioloop() {
 			o.history.Revert()
 			o.errchan <- &InterruptError{remain}
 		default:
+			if key, ok := isQuotedKey(r); ok {
+				o.buf.WriteRune(key)
+				break
+			}
+			if _, ok := IsMetaKey(r); ok {
+				// not bound to anything, left to the Listener
+				break
+			}
 			if o.IsSearchMode() {
 				o.SearchChar(r)
 				keepInSearchMode = true
 				break
 			}
-			o.buf.WriteRune(r)
+			if o.GetConfig().AutoCloseBrackets {
+				o.writeAutoClose(r)
+			} else {
+				o.buf.WriteRune(r)
+			}
 			if o.IsInCompleteMode() {
 				o.OnComplete()
 				keepInCompleteMode = true
@@ -365,6 +585,306 @@ func (o *Operation) ioloop() {
 	}
 }
 
+// readRune returns the next key, which is CharEnter once AcceptLine is
+// called. OnTick is called and the streamed candidates are shown while
+// waiting for it. The keys of a macro being replayed come first.
+func (o *Operation) readRune() rune {
+	if r, ok := o.nextMacroKey(); ok {
+		return r
+	}
+	for {
+		// before any key
+		select {
+		case <-o.resetChan:
+			o.resetModes()
+		default:
+		}
+
+		select {
+		case <-o.resetChan:
+			o.resetModes()
+		case <-o.acceptChan:
+			if atomic.LoadInt32(&o.waitingLine) == 1 {
+				return CharEnter
+			}
+		case r, ok := <-o.t.outchan:
+			if !ok {
+				return rune(0)
+			}
+			// the candidates queued before the key go first
+			select {
+			case <-o.applyChan:
+				o.applyQueued()
+			default:
+			}
+			o.t.receivedKey()
+			o.recordKey(r)
+			return r
+		case c, ok := <-o.stream:
+			o.onStream(c, ok)
+		case <-o.applyChan:
+			o.applyQueued()
+		case <-o.resizeChan:
+			if o.t.IsReading() && o.IsInCompleteMode() {
+				o.buf.Refresh(nil)
+				o.CompleteRefresh()
+			}
+		case <-o.completeTimer:
+			if o.IsInCompleteMode() {
+				o.ExitCompleteMode(true)
+				o.buf.Refresh(nil)
+			}
+		case m := <-o.flashChan:
+			o.showFlash(m)
+		case <-o.flashTimer:
+			o.stopFlash()
+			if o.t.IsReading() && !o.IsInCompleteMode() {
+				// the line is redrawn without what's below it
+				o.buf.Refresh(nil)
+			}
+		case <-o.tickChan():
+			// not between two Readline
+			if o.t.IsReading() {
+				o.GetConfig().OnTick()
+				o.buf.Refresh(nil)
+			}
+		}
+	}
+}
+
+// resetModes leaves the completion, the search and the snippet, keeping
+// the line.
+func (o *Operation) resetModes() {
+	o.ExitSnippetMode()
+	if o.IsInCompleteMode() {
+		o.ExitCompleteMode(false)
+		o.buf.Refresh(nil)
+	}
+	if o.IsSearchMode() {
+		o.ExitSearchMode(false)
+		o.buf.Refresh(nil)
+	}
+}
+
+// Reset leaves the completion and the search, if any, and empties the cut
+// buffer. Readline starts with the former anyway.
+func (o *Operation) Reset() {
+	o.buf.SetKillBuffer(nil)
+	o.requestReset()
+}
+
+// sendLine passes the line accepted to Readline, unless the last one was
+// cancelled meanwhile.
+func (o *Operation) sendLine(line []rune) {
+	select {
+	case o.outchan <- line:
+	case <-o.cancelChan:
+	}
+}
+
+func (o *Operation) requestReset() {
+	select {
+	case o.resetChan <- struct{}{}:
+	default:
+	}
+}
+
+// resetCompleteTimer restarts the CompletionTimeout countdown if the
+// candidates are shown, it stops it otherwise.
+func (o *Operation) resetCompleteTimer() {
+	if o.stopCompleteTimer != nil {
+		o.stopCompleteTimer()
+	}
+	o.completeTimer, o.stopCompleteTimer = nil, nil
+	cfg := o.GetConfig()
+	if cfg.CompletionTimeout > 0 && o.IsInCompleteMode() {
+		o.completeTimer, o.stopCompleteTimer = cfg.funcNewTimer(cfg.CompletionTimeout)
+	}
+}
+
+// tickChan returns the ticks for OnTick, or nil if it's unset. The ticker
+// is restarted when TickInterval changes.
+func (o *Operation) tickChan() <-chan time.Time {
+	cfg := o.GetConfig()
+	interval := cfg.TickInterval
+	if cfg.OnTick == nil {
+		interval = 0
+	}
+	if interval != o.tickInterval {
+		if o.stopTick != nil {
+			o.stopTick()
+		}
+		o.tick, o.stopTick = nil, nil
+		o.tickInterval = interval
+		if interval > 0 {
+			o.tick, o.stopTick = cfg.funcNewTicker(interval)
+		}
+	}
+	return o.tick
+}
+
+type flashMessage struct {
+	text string
+	d    time.Duration
+}
+
+// FlashMessage shows text below the line for d, replacing the message not
+// shown yet if any.
+func (o *Operation) FlashMessage(text string, d time.Duration) {
+	m := flashMessage{text, d}
+	for {
+		select {
+		case o.flashChan <- m:
+			return
+		default:
+		}
+		select {
+		case <-o.flashChan:
+		default:
+		}
+	}
+}
+
+// showFlash draws the message below the line, the cursor is left where it
+// was. The candidates take its place if they're shown.
+func (o *Operation) showFlash(m flashMessage) {
+	o.stopFlash()
+	cfg := o.GetConfig()
+	if !o.t.IsReading() || o.IsInCompleteMode() || cfg.usePlainOutput() {
+		return
+	}
+	width := cfg.getWidth()
+	lineCnt := o.buf.CursorLineCount()
+	lines := 1
+	if w := cfg.widthAll(runes.ColorFilter([]rune(m.text))); width > 0 && w > width {
+		lines = LineCount(width, w)
+	}
+	buf := bufio.NewWriter(o.w)
+	buf.Write(bytes.Repeat([]byte("\n"), lineCnt))
+	buf.WriteString("\033[J" + m.text)
+	fmt.Fprintf(buf, "\033[%dA\r", lineCnt-1+lines)
+	if col := o.buf.Pos() + o.buf.PromptLen(); col > 0 {
+		fmt.Fprintf(buf, "\033[%dC", col)
+	}
+	buf.Flush()
+	o.flashTimer, o.stopFlashTimer = cfg.funcNewTimer(m.d)
+}
+
+func (o *Operation) stopFlash() {
+	if o.stopFlashTimer != nil {
+		o.stopFlashTimer()
+	}
+	o.flashTimer, o.stopFlashTimer = nil, nil
+}
+
+// applyQueued writes the candidates queued by ApplyCandidate.
+func (o *Operation) applyQueued() {
+	o.applyM.Lock()
+	cs := o.applied
+	o.applied = nil
+	o.applyM.Unlock()
+	for _, c := range cs {
+		o.applyCandidate(c)
+	}
+	o.buf.Refresh(nil)
+	if o.IsInCompleteMode() {
+		// reopened for the new line
+		o.CompleteRefresh()
+	}
+	o.history.Update(o.buf.Runes(), false)
+}
+
+// ApplyCandidate queues c for the ioloop to write it to the line as if it
+// was picked from the candidates, it doesn't wait for it.
+func (o *Operation) ApplyCandidate(c Candidate) {
+	o.applyM.Lock()
+	o.applied = append(o.applied, c)
+	o.applyM.Unlock()
+	select {
+	case o.applyChan <- struct{}{}:
+	default:
+	}
+}
+
+// AcceptLine accepts the line being edited as if Enter was pressed. It's
+// ignored when Readline isn't running.
+func (o *Operation) AcceptLine() {
+	select {
+	case o.acceptChan <- struct{}{}:
+	default:
+	}
+}
+
+// abort cancels the search, the completion or the snippet in progress
+// (like Ctrl-G), restoring the line as it was before, and rings the bell.
+func (o *Operation) abort() {
+	o.ExitSnippetMode()
+	if o.IsSearchMode() {
+		o.ExitSearchMode(true)
+		o.buf.Refresh(nil)
+	}
+	if o.IsInCompleteMode() {
+		o.ExitCompleteMode(true)
+		o.buf.Refresh(nil)
+	}
+	o.t.Bell()
+}
+
+// autoClosePairs maps the runes opening a pair to the ones closing it
+// for Config.AutoCloseBrackets.
+var autoClosePairs = map[rune]rune{
+	'(': ')', '[': ']', '{': '}', '"': '"', '\'': '\'', '`': '`',
+}
+
+// writeAutoClose writes r along with its closing rune if it opens a pair,
+// or moves over r if it's the closing rune already after the cursor.
+func (o *Operation) writeAutoClose(r rune) {
+	before, after := o.buf.RunesAround()
+	if r == after && (r == ')' || r == ']' || r == '}' || autoClosePairs[r] == r) {
+		o.buf.MoveForward()
+		return
+	}
+	close, ok := autoClosePairs[r]
+	// a quote right after a word is rather an apostrophe, e.g. don't
+	if !ok || close == r && (unicode.IsLetter(before) || unicode.IsDigit(before)) {
+		o.buf.WriteRune(r)
+		return
+	}
+	o.buf.WritePair(r, close)
+}
+
+// inEmptyPair reports whether the cursor is between the runes of a pair.
+func (o *Operation) inEmptyPair() bool {
+	before, after := o.buf.RunesAround()
+	close, ok := autoClosePairs[before]
+	return ok && close == after
+}
+
+// writeTranscript writes the prompt and the line accepted to the
+// TranscriptWriter, if any, the password being left out.
+func (o *Operation) writeTranscript(line []rune) {
+	w := o.GetConfig().TranscriptWriter
+	if w == nil {
+		return
+	}
+	if o.IsInPasswordMode() {
+		line = nil
+	}
+	io.WriteString(w, o.buf.Prompt()+string(line)+"\n")
+}
+
+func (o *Operation) onHistoryMove(line []rune) {
+	if f := o.GetConfig().OnHistoryMove; f != nil {
+		f(string(line), o.history.currentIndex())
+	}
+}
+
+// insertTabSpaces pads the line with spaces up to the next tab stop.
+func (o *Operation) insertTabSpaces() {
+	col := o.buf.CurrentWidth(o.buf.Pos())
+	o.buf.WriteString(strings.Repeat(" ", TabWidth-col%TabWidth))
+}
+
 func (o *Operation) Stderr() io.Writer {
 	return &wrapWriter{target: o.GetConfig().Stderr, r: o, t: o.t}
 }
@@ -379,6 +899,12 @@ func (o *Operation) String() (string, error) {
 }
 
 func (o *Operation) Runes() ([]rune, error) {
+	return o.runes(context.Background())
+}
+
+// runes reads a line like Runes, it gives up and returns ctx.Err() once
+// ctx is done.
+func (o *Operation) runes(ctx context.Context) ([]rune, error) {
 	o.t.EnterRawMode()
 	defer o.t.ExitRawMode()
 
@@ -387,6 +913,21 @@ func (o *Operation) Runes() ([]rune, error) {
 		listener.OnChange(nil, 0, 0)
 	}
 
+	if f := o.GetConfig().FuncStatusPrompt; f != nil {
+		o.SetPrompt(f(atomic.LoadInt32(&o.promptFailed) == 0))
+	}
+	// a line accepted from now on is for this call
+	select {
+	case <-o.cancelChan:
+	default:
+	}
+	select {
+	case <-o.acceptChan:
+	default:
+	}
+	atomic.StoreInt32(&o.waitingLine, 1)
+	defer atomic.StoreInt32(&o.waitingLine, 0)
+	o.requestReset()
 	o.buf.Refresh(nil) // print prompt
 	o.t.KickRead()
 	select {
@@ -397,6 +938,18 @@ func (o *Operation) Runes() ([]rune, error) {
 			return e.Line, ErrInterrupt
 		}
 		return nil, err
+	case <-ctx.Done():
+		// drop what has been typed so far, and the line if it's accepted
+		// before the next call
+		select {
+		case o.cancelChan <- struct{}{}:
+		default:
+		}
+		if !o.GetConfig().UniqueEditLine {
+			o.buf.WriteString("\n")
+		}
+		o.buf.Reset()
+		return nil, ctx.Err()
 	}
 }
 
@@ -412,11 +965,25 @@ func (o *Operation) GenPasswordConfig() *Config {
 }
 
 func (o *Operation) PasswordWithConfig(cfg *Config) ([]byte, error) {
+	return o.passwordWithContext(context.Background(), cfg)
+}
+
+func (o *Operation) PasswordWithContext(ctx context.Context, prompt string) ([]byte, error) {
+	cfg := o.GenPasswordConfig()
+	cfg.Prompt = prompt
+	return o.passwordWithContext(ctx, cfg)
+}
+
+func (o *Operation) passwordWithContext(ctx context.Context, cfg *Config) ([]byte, error) {
 	if err := o.opPassword.EnterPasswordMode(cfg); err != nil {
 		return nil, err
 	}
 	defer o.opPassword.ExitPasswordMode()
-	return o.Slice()
+	r, err := o.runes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(string(r)), nil
 }
 
 func (o *Operation) Password(prompt string) ([]byte, error) {
@@ -466,10 +1033,11 @@ func (op *Operation) SetConfig(cfg *Config) (*Config, error) {
 	}
 	old := op.cfg
 	op.cfg = cfg
+	// the prompt is measured with the RuneWidthFunc of cfg
+	op.buf.SetConfig(cfg)
 	op.SetPrompt(cfg.Prompt)
 	op.SetMaskRune(cfg.MaskRune)
-	op.buf.SetConfig(cfg)
-	width := op.cfg.FuncGetWidth()
+	width := op.cfg.getWidth()
 
 	if cfg.opHistory == nil {
 		op.SetHistoryPath(cfg.HistoryFile)
@@ -9,6 +9,10 @@ func newOpPassword(o *Operation) *opPassword {
 	return &opPassword{o: o}
 }
 
+func (o *opPassword) IsInPasswordMode() bool {
+	return o.backupCfg != nil
+}
+
 func (o *opPassword) ExitPasswordMode() {
 	o.o.SetConfig(o.backupCfg)
 	o.backupCfg = nil
@@ -29,5 +33,7 @@ func (o *opPassword) PasswordConfig() *Config {
 
 		Stdout: o.o.cfg.Stdout,
 		Stderr: o.o.cfg.Stderr,
+		// the prompt is logged, not the password
+		TranscriptWriter: o.o.cfg.TranscriptWriter,
 	}
 }
@@ -81,6 +81,8 @@ next:
 			target = CharPrev
 		case VK_DOWN:
 			target = CharNext
+		case VK_DELETE:
+			return copy(buf, "\033[3~"), nil
 		}
 		if target != 0 {
 			return r.write(buf, target)
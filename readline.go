@@ -18,7 +18,11 @@
 package readline
 
 import (
+	"context"
 	"io"
+	"os"
+	"strings"
+	"time"
 )
 
 type Instance struct {
@@ -29,32 +33,207 @@ type Instance struct {
 
 type Config struct {
 	// prompt supports ANSI escape sequence, so we can color some characters even in windows
+	// and the parts wrapped in \001...\002 are printed as is but take no width
 	Prompt string
+	// if set, the prompt of each line is the one it returns for the status
+	// set last by Instance.SetPromptStatus (true at first), e.g. to color
+	// it red after a failed command; it takes precedence over Prompt
+	FuncStatusPrompt func(ok bool) string
 
 	// readline will persist historys to file where HistoryFile specified
 	HistoryFile string
+	// the permissions of the HistoryFile when it's created or rewritten,
+	// 0600 by default as it may hold sensitive commands
+	HistoryFilePerm os.FileMode
 	// specify the max length of historys, it's 500 by default, set it to -1 to disable history
-	HistoryLimit           int
+	HistoryLimit int
+	// the edits to a recalled entry are kept when moving away from it, and
+	// shown when coming back until a line is accepted (like zsh); by
+	// default they're dropped (like bash). The history itself is unchanged.
+	PreserveHistoryEdits bool
+	// Up and Down only go through the lines entered since the start, the
+	// lines loaded from the HistoryFile are still found by the search
+	SessionOnlyHistoryNavigation bool
+	// remove the trailing spaces of the accepted lines (but passwords)
+	TrimTrailingSpace bool
+	// Enter on an empty line prompts again rather than returning "", so
+	// Readline only returns "" on an error (e.g. io.EOF). It stands for an
+	// AcceptEmptyLine option defaulting to true, which the zero Config
+	// couldn't tell apart from one set to false.
+	IgnoreEmptyLine bool
+	// don't save the accepted lines automatically, use SaveToHistory instead
 	DisableAutoSaveHistory bool
 	// enable case-insensitive history searching
 	HistorySearchFold bool
+	// if set, the history search (Ctrl-R / Ctrl-S) shows the entries it
+	// matches (e.g. fuzzily) instead of those holding the keyword, the
+	// ranges of runes [start, end) of entry are underlined
+	HistoryMatcher func(entry, query string) (matched bool, highlightRanges [][2]int)
+	// the prompt of the history search (Ctrl-R / Ctrl-S), %s is replaced by
+	// the keyword, "bck-i-search: %s" or "fwd-i-search: %s" by default
+	SearchPrompt string
+	// the prompt of the history search when nothing matches the keyword,
+	// "failing " followed by the SearchPrompt by default
+	SearchFailingPrompt string
+	// if set, the backward search (Ctrl-R) looks for the matches in the
+	// entries of the returned iterator instead of the in-memory history
+	FuncHistoryIterator func() HistoryIterator
+	// called with the entry shown when moving through the history (Up/Down),
+	// index is its position in the history, 0 being the oldest entry
+	OnHistoryMove func(line string, index int)
 
 	// AutoCompleter will called once user press TAB
 	AutoComplete AutoCompleter
+	// when no AutoComplete is set, pad with spaces up to the next tab stop
+	// (see TabWidth) instead of inserting a literal tab
+	TabInsertsSpaces bool
+	// the key triggering the completion, it's Tab by default
+	CompleteKey rune
+	// the terminal sends DEL (0x7f) for the Delete key rather than for
+	// Backspace, which then sends BS (0x08)
+	BackspaceIsDelete bool
+	// if > 0, Backspace deletes the spaces back to the previous multiple of
+	// it when only spaces precede the cursor, e.g. 4 for a code REPL
+	SmartBackspaceIndent int
+	// typing one of ( [ { or a quote writes the closing rune after the
+	// cursor too, typing the closing rune moves over it and Backspace
+	// deletes both runes of an empty pair, e.g. for a code REPL
+	AutoCloseBrackets bool
+	// the key completing the line and accepting it when there is only one
+	// candidate, it shows the candidates like CompleteKey otherwise,
+	// unbound by default
+	CompleteAndAcceptKey rune
+	// the key cutting the whole line regardless of the cursor position
+	// (kill-whole-line), e.g. CharCtrlU, it's unbound by default
+	KillWholeLineKey rune
+	// the key cutting from the cursor to the bracket matching the next one
+	// (like d% in vim), it's unbound by default
+	DeleteToMatchingBracketKey rune
+	// the key inserting the current time at the cursor (insert-datetime),
+	// formatted with DateTimeFormat ("2006-01-02 15:04:05" by default),
+	// it's unbound by default
+	InsertDateTimeKey rune
+	DateTimeFormat    string
+	// match the typed word regardless of case, the AutoComplete should
+	// honour it, the candidates are highlighted accordingly
+	// (see CompletionHighlightTyped)
+	CompletionIgnoreCase bool
+	// ring the bell when the candidates are shown as the completion is
+	// ambiguous, like bash does
+	BellOnAmbiguous bool
+	// fill the candidate grid down-then-across (like `ls`) instead of across-then-down
+	CompletionColumnMajor bool
+	// show in bold the part of the candidates already typed
+	CompletionHighlightTyped bool
+	// the string between the columns of the candidate grid (and before the
+	// descriptions), e.g. " │ ", the columns are padded with spaces if unset
+	CompletionColumnSep string
+	// limit the number of columns of the candidate grid, unlimited if <= 0
+	CompletionMaxColumns int
+	// shorten the candidates wider than this with an ellipsis in the grid,
+	// unlimited if <= 0
+	CompletionMaxDisplayWidth int
+	// reorder the candidates before they are shown, e.g. to list the
+	// directories first
+	CompletionSort func([]Candidate) []Candidate
+	// change how the candidates look in the grid, e.g. to number them
+	// "1) foo"; it's given a copy of the candidates in the order they're
+	// shown and must return as many, only their Display (and Prefix and
+	// Description) are used, what's written is still the NewLine
+	CompletionDisplayTransform func([]Candidate) []Candidate
+	// hide the candidates when no key is pressed for this duration, e.g.
+	// to not leave file names on a shared screen, unlimited if <= 0
+	CompletionTimeout time.Duration
+	// show the candidates in the same Tab which inserted their common
+	// prefix instead of waiting for the next one
+	MenuOnPrefixComplete bool
+	// show below the grid the line as it would be once the highlighted
+	// candidate is accepted, e.g. for candidates replacing most of the line
+	ShowCompletionPreview bool
+	// complete the line again once a candidate is written if it returns
+	// true, e.g. for the directories to complete the next path segment
+	ReopenCompletionAfterAccept func(accepted Candidate) bool
+	// the keys writing the selected candidate along with Enter and Ctrl-J,
+	// e.g. CharForward, they lose their meaning in the candidate selection
+	CompletionAcceptKeys []rune
+	// while a candidate is selected, the digits 1 to 9 write the candidate
+	// of that number right away, e.g. along with a CompletionDisplayTransform
+	// numbering them; a digit past the candidates rings the bell
+	CompletionQuickSelect bool
+	// let a click on a candidate of the grid write it, the terminal is
+	// asked to report the mouse clicks while Readline is in progress
+	EnableMouse bool
+	// draw the candidates in place of the built-in grid
+	CompletionRenderer CompletionRenderer
+	// called with true when the candidates are shown and with false once
+	// they're hidden, e.g. to toggle a help footer
+	OnCompleteModeChange func(active bool)
 
 	// Any key press will pass to Listener
 	// NOTE: Listener will be triggered by (nil, 0, 0) immediately
 	Listener Listener
 
 	Painter Painter
+	// if set, a line wider than the terminal wraps before the last column
+	// which shows this rune (e.g. '\\'), instead of relying on the terminal
+	// to wrap it; the Painter is then called for each row on its own
+	WrapIndicator rune
 
 	// If VimMode is true, readline will in vim.insert mode by default
 	VimMode bool
+	// the keys bound in each keymap, overlaid on the built-in bindings:
+	// EmacsKeyMap applies when VimMode is off, VimInsertKeyMap and
+	// VimNormalKeyMap in the vim modes. The vim insert mode inherits the
+	// emacs shortcuts, VimInsertKeyMap may unbind the unwanted ones.
+	EmacsKeyMap     KeyMap
+	VimInsertKeyMap KeyMap
+	VimNormalKeyMap KeyMap
+
+	// read the settings from this inputrc file (e.g. "~/.inputrc") on
+	// Init, they take precedence over the fields set. Only these lines
+	// are understood:
+	//   - `set` of editing-mode, completion-ignore-case and history-size
+	//     (a negative size keeps all the lines, 0 none)
+	//   - a single key bound to one of the functions complete,
+	//     kill-whole-line, delete-to-matching-bracket and insert-datetime,
+	//     which set the Key fields, or to a function of the shortcuts (e.g.
+	//     beginning-of-line, previous-history, history-search-backward,
+	//     forward-word), added to EmacsKeyMap or to VimInsertKeyMap in vi
+	//     mode
+	// The others are reported to InputrcWarningWriter (Stderr of the
+	// Config if nil) and ignored. A missing file is ignored too.
+	InputrcPath          string
+	InputrcWarningWriter io.Writer
 
 	InterruptPrompt string
 	EOFPrompt       string
 
 	FuncGetWidth func() int
+	// the number of rows of the terminal, only reported by Instance.Size
+	FuncGetHeight func() int
+	// the width assumed when FuncGetWidth can't tell it (returns <= 0),
+	// e.g. 80, otherwise the completion is disabled in that case
+	DefaultWidth int
+
+	// an ESC not followed by another key within this duration is read as
+	// a key on its own rather than the Meta prefix, 50ms by default.
+	// Set it to a negative value to always wait for the next key.
+	EscapeTimeout time.Duration
+
+	// if both are set, OnTick is called every TickInterval while Readline
+	// waits for the input, and the line is redrawn after it, e.g. to
+	// animate a spinner in the prompt with SetPrompt. The ticks are taken
+	// along with the keys so OnTick never runs during a key handling.
+	TickInterval time.Duration
+	OnTick       func()
+
+	// write every key read from the terminal along with its raw bytes,
+	// for diagnosing key handling issues
+	DebugKeyLog io.Writer
+	// write the prompt and the line accepted, followed by "\n", each time
+	// one is, e.g. to log a transcript of the session. The passwords are
+	// left out.
+	TranscriptWriter io.Writer
 
 	Stdin       io.ReadCloser
 	StdinWriter io.Writer
@@ -64,32 +243,95 @@ type Config struct {
 	EnableMask bool
 	MaskRune   rune
 
+	// the number of columns a rune takes on the screen, used for the cursor
+	// position, the line wrapping and the candidate grid; the built-in
+	// table (East Asian wide runes take 2) is used if nil
+	RuneWidthFunc func(r rune) int
+
 	// erase the editing line after user submited it
 	// it use in IM usually.
 	UniqueEditLine bool
+	// don't move to the next line once a line is accepted, the cursor is
+	// left at its end so that what's printed next follows it, e.g. " ok"
+	NoNewlineOnAccept bool
 
 	// filter input runes (may be used to disable CtrlZ or for translating some keys to different actions)
 	// -> output = new (translated) rune and true/false if continue with processing this one
+	// It sees the keys first, before the KeyMap of the mode and the vim normal mode
 	FuncFilterInputRune func(rune) (rune, bool)
 
+	// drop the control characters but newlines from pasted text, so that
+	// it can't run editing commands; a paste is told from typing as it
+	// arrives at once, the input returned by one read being longer than
+	// any key sequence (16 bytes and more). Pasted tabs are inserted.
+	SanitizePaste bool
+
 	// force use interactive even stdout is not a tty
 	FuncIsTerminal      func() bool
 	FuncMakeRaw         func() error
 	FuncExitRaw         func() error
 	FuncOnWidthChanged  func(func())
 	ForceUseInteractive bool
+	// called once the terminal is switched to the raw mode for reading a
+	// line and once it's restored, e.g. to pause another reader of stdin
+	OnEnterRawMode func()
+	OnExitRawMode  func()
+	// write no escape sequences (no cursor movement, completion grid or
+	// search prompt) and leave the line editing to the terminal, it's
+	// implied when Stdout isn't a terminal, e.g. `myrepl | tee log`
+	ForcePlainOutput bool
 
 	// private fields
 	inited    bool
 	opHistory *opHistory
 	opSearch  *opSearch
+	// start the ticker for OnTick and the timer for CompletionTimeout,
+	// replaced by a fake clock in the tests
+	funcNewTicker func(time.Duration) (<-chan time.Time, func())
+	funcNewTimer  func(time.Duration) (<-chan time.Time, func())
+	// the clock of InsertDateTimeKey
+	funcNow func() time.Time
+	// turn the terminal autowrap off while drawing the candidate grid, the
+	// rows wider than the screen are then cut rather than wrapped
+	gridNoAutowrap bool
+}
+
+// getWidth returns the terminal width, falling back to DefaultWidth.
+func (c *Config) getWidth() int {
+	if width := c.FuncGetWidth(); width > 0 {
+		return width
+	}
+	return c.DefaultWidth
+}
+
+// runeWidth returns the columns taken by r, see RuneWidthFunc.
+func (c *Config) runeWidth(r rune) int {
+	if c.RuneWidthFunc != nil {
+		return c.RuneWidthFunc(r)
+	}
+	return runes.Width(r)
+}
+
+// widthAll returns the columns taken by rs, see RuneWidthFunc.
+func (c *Config) widthAll(rs []rune) (width int) {
+	for _, r := range rs {
+		width += c.runeWidth(r)
+	}
+	return
 }
 
 func (c *Config) useInteractive() bool {
+	if c.ForcePlainOutput {
+		return false
+	}
 	if c.ForceUseInteractive {
 		return true
 	}
-	return c.FuncIsTerminal()
+	return c.FuncIsTerminal() && isOutputTerminal(c.Stdout)
+}
+
+func (c *Config) usePlainOutput() bool {
+	return c.ForcePlainOutput || !isOutputTerminal(c.Stdout)
 }
 
 func (c *Config) Init() error {
@@ -97,6 +339,11 @@ func (c *Config) Init() error {
 		return nil
 	}
 	c.inited = true
+	if c.InputrcPath != "" {
+		if err := c.loadInputrc(); err != nil {
+			return err
+		}
+	}
 	if c.Stdin == nil {
 		c.Stdin = NewCancelableStdin(Stdin)
 	}
@@ -109,6 +356,9 @@ func (c *Config) Init() error {
 	if c.Stderr == nil {
 		c.Stderr = Stderr
 	}
+	if c.HistoryFilePerm == 0 {
+		c.HistoryFilePerm = 0600
+	}
 	if c.HistoryLimit == 0 {
 		c.HistoryLimit = 500
 	}
@@ -124,12 +374,21 @@ func (c *Config) Init() error {
 		c.EOFPrompt = ""
 	}
 
+	if c.EscapeTimeout == 0 {
+		c.EscapeTimeout = 50 * time.Millisecond
+	}
+	if c.CompleteKey == 0 {
+		c.CompleteKey = CharTab
+	}
 	if c.AutoComplete == nil {
 		c.AutoComplete = &TabCompleter{}
 	}
 	if c.FuncGetWidth == nil {
 		c.FuncGetWidth = GetScreenWidth
 	}
+	if c.FuncGetHeight == nil {
+		c.FuncGetHeight = GetScreenHeight
+	}
 	if c.FuncIsTerminal == nil {
 		c.FuncIsTerminal = DefaultIsTerminal
 	}
@@ -143,6 +402,24 @@ func (c *Config) Init() error {
 	if c.FuncOnWidthChanged == nil {
 		c.FuncOnWidthChanged = DefaultOnWidthChanged
 	}
+	if c.funcNewTicker == nil {
+		c.funcNewTicker = func(d time.Duration) (<-chan time.Time, func()) {
+			ticker := time.NewTicker(d)
+			return ticker.C, ticker.Stop
+		}
+	}
+	if c.funcNewTimer == nil {
+		c.funcNewTimer = func(d time.Duration) (<-chan time.Time, func()) {
+			timer := time.NewTimer(d)
+			return timer.C, func() { timer.Stop() }
+		}
+	}
+	if c.funcNow == nil {
+		c.funcNow = time.Now
+	}
+	if c.DateTimeFormat == "" {
+		c.DateTimeFormat = "2006-01-02 15:04:05"
+	}
 
 	return nil
 }
@@ -166,10 +443,10 @@ func NewEx(cfg *Config) (*Instance, error) {
 	if err != nil {
 		return nil, err
 	}
-	rl := t.Readline()
 	if cfg.Painter == nil {
 		cfg.Painter = &defaultPainter{}
 	}
+	rl := t.Readline()
 	return &Instance{
 		Config:    cfg,
 		Terminal:  t,
@@ -189,6 +466,13 @@ func (i *Instance) SetPrompt(s string) {
 	i.Operation.SetPrompt(s)
 }
 
+// SetPromptStatus sets the status of the last command (e.g. whether it
+// succeeded), Config.FuncStatusPrompt makes the prompt of the next lines
+// from it.
+func (i *Instance) SetPromptStatus(ok bool) {
+	i.Operation.SetPromptStatus(ok)
+}
+
 func (i *Instance) SetMaskRune(r rune) {
 	i.Operation.SetMaskRune(r)
 }
@@ -217,6 +501,12 @@ func (i *Instance) IsVimMode() bool {
 	return i.Operation.IsEnableVimMode()
 }
 
+// IsVimInsertMode reports whether vim mode is on and in insert mode, e.g.
+// for a FuncFilterInputRune binding a key in this mode only.
+func (i *Instance) IsVimInsertMode() bool {
+	return i.Operation.IsVimInsertMode()
+}
+
 func (i *Instance) GenPasswordConfig() *Config {
 	return i.Operation.GenPasswordConfig()
 }
@@ -234,6 +524,12 @@ func (i *Instance) ReadPassword(prompt string) ([]byte, error) {
 	return i.Operation.Password(prompt)
 }
 
+// ReadPasswordWithContext is like ReadPassword but gives up once ctx is done,
+// it returns ctx.Err() after restoring the terminal.
+func (i *Instance) ReadPasswordWithContext(ctx context.Context, prompt string) ([]byte, error) {
+	return i.Operation.PasswordWithContext(ctx, prompt)
+}
+
 type Result struct {
 	Line  string
 	Error error
@@ -262,10 +558,148 @@ func (i *Instance) ReadlineWithDefault(what string) (string, error) {
 	return i.Operation.String()
 }
 
+// ReadBlock reads lines, each one edited as with Readline, until one equal
+// to terminator or Ctrl-D on an empty line, and returns them joined by
+// "\n", e.g. for the user to paste a configuration. The terminator isn't
+// part of the block, and io.EOF is only returned if no line was read.
+func (i *Instance) ReadBlock(terminator string) (string, error) {
+	var lines []string
+	for {
+		line, err := i.Readline()
+		if err == io.EOF && len(lines) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if line == terminator {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// SetBuffer replaces the line being edited (or the one the next Readline
+// starts with) by text, with the cursor at the rune offset pos, which is
+// clamped to the line, e.g. to drop the cursor inside a template.
+func (i *Instance) SetBuffer(text string, pos int) {
+	i.Operation.SetBufferWithCursor(text, pos)
+}
+
+// Size returns the size of the terminal as readline sees it (see
+// FuncGetWidth and FuncGetHeight). An unknown dimension is reported as
+// 80 columns (or DefaultWidth) and 24 rows.
+func (i *Instance) Size() (cols, rows int) {
+	cfg := i.Operation.GetConfig()
+	if cols = cfg.getWidth(); cols <= 0 {
+		cols = 80
+	}
+	if rows = cfg.FuncGetHeight(); rows <= 0 {
+		rows = 24
+	}
+	return cols, rows
+}
+
+// Reset leaves the completion and the search in progress, if any, and
+// empties the cut buffer, e.g. between two unrelated sessions of a REPL.
+// The line being edited is kept.
+func (i *Instance) Reset() {
+	i.Operation.Reset()
+}
+
+// Insert text at the cursor position of the line being edited,
+// e.g. for pasting from the clipboard.
+func (i *Instance) Insert(text string) {
+	i.Operation.Insert(text)
+}
+
+// MoveCursor moves the cursor of the line being edited by delta runes,
+// it stops at the start or the end of the line.
+func (i *Instance) MoveCursor(delta int) {
+	i.Operation.MoveCursor(delta)
+}
+
+// MoveToLineStart moves the cursor to the start of the buffer, which Ctrl-A
+// does too unless the buffer holds several lines.
+func (i *Instance) MoveToLineStart() {
+	i.Operation.MoveToLineStart()
+}
+
+// MoveToLineEnd moves the cursor to the end of the buffer, which Ctrl-E
+// does too unless the buffer holds several lines.
+func (i *Instance) MoveToLineEnd() {
+	i.Operation.MoveToLineEnd()
+}
+
+// MoveWordLeft moves the cursor to the previous word start (like Meta-B).
+func (i *Instance) MoveWordLeft() {
+	i.Operation.MoveWordLeft()
+}
+
+// MoveWordRight moves the cursor to the next word start (like Meta-F).
+func (i *Instance) MoveWordRight() {
+	i.Operation.MoveWordRight()
+}
+
+// ApplyCandidate writes c to the line being edited as if the user picked it
+// from the candidates (e.g. for a scripted demo): its ReplaceStart and
+// ReplaceEnd, its snippet and Config.ReopenCompletionAfterAccept are
+// honoured. A NewLine without replace range is the whole new line, of
+// which the part shared with the current line is kept. It doesn't wait for
+// the line editor, which writes c once it's done with the current key, so
+// it may be called from any goroutine or callback. After Close, c is
+// dropped.
+func (i *Instance) ApplyCandidate(c Candidate) {
+	i.Operation.ApplyCandidate(c)
+}
+
+// AcceptLine makes the pending Readline return the line being edited as if
+// Enter was pressed, e.g. from a Listener bound to another key. It's safe
+// to call from any goroutine, but only while Readline is in progress.
+func (i *Instance) AcceptLine() {
+	i.Operation.AcceptLine()
+}
+
+// FlashMessage shows text on the line below the one being edited for d,
+// e.g. "Copied!", without changing the line or moving the cursor. It's
+// cleared sooner if the line is redrawn (e.g. by a key) and isn't shown
+// while the candidates are. It's safe to call from any goroutine, but only
+// while Readline is in progress.
+func (i *Instance) FlashMessage(text string, d time.Duration) {
+	i.Operation.FlashMessage(text, d)
+}
+
+// LastKeyBytes returns the raw bytes read from the terminal for the last
+// key dispatched to the line editor, e.g. "\033[1;5C" for Ctrl-Right, nil
+// before any key. Written back with WriteStdin they replay the key, which
+// is how keystrokes can be recorded as a macro.
+func (i *Instance) LastKeyBytes() []byte {
+	return i.Terminal.LastKeyBytes()
+}
+
+// GetCutBuffer returns the text cut last (e.g. by Ctrl-K or Ctrl-U),
+// which is pasted by Ctrl-Y.
+func (i *Instance) GetCutBuffer() string {
+	return i.Operation.GetCutBuffer()
+}
+
+// SetCutBuffer replaces the text pasted by Ctrl-Y,
+// e.g. to keep it in sync with the system clipboard.
+func (i *Instance) SetCutBuffer(text string) {
+	i.Operation.SetCutBuffer(text)
+}
+
 func (i *Instance) SaveHistory(content string) error {
 	return i.Operation.SaveHistory(content)
 }
 
+// SaveToHistory records line in the history explicitly, it's meant to be
+// used along with DisableAutoSaveHistory to choose which lines to keep.
+func (i *Instance) SaveToHistory(line string) error {
+	return i.Operation.SaveHistory(line)
+}
+
 // same as readline
 func (i *Instance) ReadSlice() ([]byte, error) {
 	return i.Operation.Slice()
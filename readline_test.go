@@ -1,6 +1,14 @@
 package readline
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,3 +33,883 @@ func TestRace(t *testing.T) {
 
 	rl.Readline()
 }
+
+// newTestInstance returns an instance reading keys from the returned writer.
+func newTestInstance(t *testing.T, cfg *Config) (*Instance, io.Writer) {
+	r, w := io.Pipe()
+	cfg.Stdin = r
+	if cfg.Stdout == nil {
+		cfg.Stdout = ioutil.Discard
+	}
+	if cfg.FuncIsTerminal == nil {
+		cfg.FuncIsTerminal = func() bool { return false }
+	}
+	if cfg.FuncGetWidth == nil {
+		cfg.FuncGetWidth = func() int { return 80 }
+	}
+	cfg.FuncMakeRaw = func() error { return nil }
+	cfg.FuncExitRaw = func() error { return nil }
+	if cfg.FuncOnWidthChanged == nil {
+		cfg.FuncOnWidthChanged = func(func()) {}
+	}
+	rl, err := NewEx(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		w.Close()
+		rl.Close()
+	})
+	return rl, w
+}
+
+func expectLine(t *testing.T, rl *Instance, expect string) {
+	t.Helper()
+	line, err := rl.Readline()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != expect {
+		t.Fatalf("expected %q, got %q", expect, line)
+	}
+}
+
+func TestSaveToHistory(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{DisableAutoSaveHistory: true})
+	go w.Write([]byte("first\rsecond\r\x10\x10\r"))
+
+	expectLine(t, rl, "first")
+	expectLine(t, rl, "second")
+	if err := rl.SaveToHistory("first"); err != nil {
+		t.Fatal(err)
+	}
+	// only the explicitly saved line can be recalled
+	expectLine(t, rl, "first")
+}
+
+func TestSplitUTF8Input(t *testing.T) {
+	var keys []rune
+	rl, w := newTestInstance(t, &Config{
+		Listener: FuncListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+			if key != 0 && key != CharEnter {
+				keys = append(keys, key)
+			}
+			return nil, 0, false
+		}),
+	})
+	go func() {
+		for _, b := range []byte("你\r") {
+			w.Write([]byte{b})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	expectLine(t, rl, "你")
+	if len(keys) != 1 || keys[0] != '你' {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	rl, _ := newTestInstance(t, &Config{})
+	rl.Operation.buf.SetWithIdx(5, []rune("hello world"))
+	rl.Insert(", 你好")
+
+	if line := string(rl.Operation.buf.Runes()); line != "hello, 你好 world" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if pos := rl.Operation.buf.Pos(); pos != 9 {
+		t.Fatalf("unexpected cursor %d", pos)
+	}
+}
+
+func TestCompleteKey(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{
+		CompleteKey:  CharCtrlSpace,
+		AutoComplete: NewPrefixCompleter(PcItem("hello")),
+	})
+	go w.Write([]byte("\th\x00\r"))
+
+	expectLine(t, rl, "\thello ")
+}
+
+func TestCompleteAndAcceptKey(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{
+		CompleteAndAcceptKey: CharCtrlSpace,
+		AutoComplete: NewPrefixCompleter(
+			PcItem("hello"), PcItem("help"), PcItem("world"),
+		),
+	})
+	go func() {
+		w.Write([]byte("wo\x00"))
+		// ambiguous, shows the candidates rather than accepting
+		w.Write([]byte("he\x00llo\r"))
+	}()
+
+	expectLine(t, rl, "world ")
+	expectLine(t, rl, "hello")
+}
+
+func TestTabInsertsSpaces(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{TabInsertsSpaces: true})
+	go w.Write([]byte("abc\tx\r\tx\t\r"))
+
+	expectLine(t, rl, "abc x")
+	expectLine(t, rl, "    x   ")
+}
+
+func TestMetaKey(t *testing.T) {
+	var metaKeys []rune
+	rl, w := newTestInstance(t, &Config{
+		Listener: FuncListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+			if k, ok := IsMetaKey(key); ok {
+				metaKeys = append(metaKeys, k)
+			}
+			return nil, 0, false
+		}),
+	})
+	go w.Write([]byte("hello world\x01\033fX\033x\r"))
+
+	expectLine(t, rl, "hello Xworld")
+	if len(metaKeys) != 1 || metaKeys[0] != 'x' {
+		t.Fatalf("unexpected meta keys: %q", metaKeys)
+	}
+}
+
+func TestCutBuffer(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	go func() {
+		w.Write([]byte("hello world\x01\033f\x0b\r"))
+		w.Write([]byte("hello \x19\r"))
+	}()
+
+	expectLine(t, rl, "hello ")
+	if cut := rl.GetCutBuffer(); cut != "world" {
+		t.Fatalf("unexpected cut buffer %q", cut)
+	}
+	rl.SetCutBuffer("there")
+	expectLine(t, rl, "hello there")
+}
+
+func TestKillWholeLine(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{KillWholeLineKey: CharCtrlU})
+	// the cursor is in the middle of the line
+	go w.Write([]byte("hello world\x01\x06\x06\x06\x15\r"))
+
+	expectLine(t, rl, "")
+	if cut := rl.GetCutBuffer(); cut != "hello world" {
+		t.Fatalf("unexpected cut buffer %q", cut)
+	}
+}
+
+func TestDeleteToMatchingBracketKey(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{DeleteToMatchingBracketKey: MetaKey('%')})
+	// from before "(a(b)c)", then on a line without brackets
+	go w.Write([]byte("f(a(b)c);\x01\x06\033%\rabc\033%\r"))
+	expectLine(t, rl, "f;")
+	if cut := rl.GetCutBuffer(); cut != "(a(b)c)" {
+		t.Fatalf("unexpected cut buffer %q", cut)
+	}
+	expectLine(t, rl, "abc")
+}
+
+func TestUpDownMultiline(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	rl.SaveHistory("old")
+	go func() {
+		// Ctrl-V Ctrl-J inserts a newline, Ctrl-P / Ctrl-N are Up / Down
+		w.Write([]byte("ab\x16\ncd\x10X\r"))
+		w.Write([]byte("a\x16\nbcd\x10X\r"))
+		w.Write([]byte("ab\x16\nc\x01\x10\x0eY\r"))
+		w.Write([]byte("ab\x16\ncd\x10\x10\r"))
+	}()
+	expectLine(t, rl, "abX\ncd")
+	// the column is kept if the line is long enough
+	expectLine(t, rl, "aX\nbcd")
+	expectLine(t, rl, "ab\nYc")
+	// on the first line, Up goes through the history
+	expectLine(t, rl, "ab\nYc")
+}
+
+func TestInsertDateTimeKey(t *testing.T) {
+	now := func() time.Time { return time.Date(2024, 3, 9, 14, 5, 0, 0, time.UTC) }
+	rl, w := newTestInstance(t, &Config{InsertDateTimeKey: MetaKey('t'), funcNow: now})
+	go w.Write([]byte("note \033t: x\r"))
+	expectLine(t, rl, "note 2024-03-09 14:05:00: x")
+
+	rl, w = newTestInstance(t, &Config{
+		InsertDateTimeKey: MetaKey('t'),
+		DateTimeFormat:    "[15:04]",
+		funcNow:           now,
+	})
+	// at the cursor
+	go w.Write([]byte("ab\x02\033t\r"))
+	expectLine(t, rl, "a[14:05]b")
+}
+
+func TestLineStartEndMultiline(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	go func() {
+		// Ctrl-V Ctrl-J inserts a newline
+		w.Write([]byte("ab\x16\ncd\x01X\r"))
+		w.Write([]byte("ab\x16\ncd\x01\x01X\r"))
+		w.Write([]byte("ab\x16\ncd\x01\x01\x05Y\r"))
+		w.Write([]byte("ab\x16\ncd\x01\x01\x05\x05Z\r"))
+	}()
+	expectLine(t, rl, "ab\nXcd")
+	expectLine(t, rl, "Xab\ncd")
+	expectLine(t, rl, "abY\ncd")
+	expectLine(t, rl, "ab\ncdZ")
+}
+
+func TestKillAndYank(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	go func() {
+		// Ctrl-K after "hello", then paste it at the start
+		w.Write([]byte("hello world\x01\x06\x06\x06\x06\x06\x0b\x01\x19\r"))
+		// Ctrl-U before "world", then paste it at the end
+		w.Write([]byte("hello world\x02\x02\x02\x02\x02\x15\x05\x19\r"))
+	}()
+
+	expectLine(t, rl, " worldhello")
+	expectLine(t, rl, "worldhello ")
+}
+
+func TestReadPasswordWithContext(t *testing.T) {
+	cfg := &Config{}
+	rl, w := newTestInstance(t, cfg)
+	var exited int32
+	cfg.FuncExitRaw = func() error {
+		atomic.AddInt32(&exited, 1)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		w.Write([]byte("sec"))
+		cancel()
+	}()
+	pswd, err := rl.ReadPasswordWithContext(ctx, "password: ")
+	if err != context.Canceled || pswd != nil {
+		t.Fatalf("unexpected result %q, %v", pswd, err)
+	}
+	if atomic.LoadInt32(&exited) != 1 {
+		t.Fatal("should restore the terminal")
+	}
+}
+
+func TestReadlineAfterCancel(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rl.ReadPasswordWithContext(ctx, "password: "); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the line entered once nothing waits for it is dropped
+	w.Write([]byte("stale\r"))
+	deadline := time.Now().Add(time.Second)
+	for len(rl.Operation.cancelChan) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the line isn't dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go w.Write([]byte("next\r"))
+	expectLine(t, rl, "next")
+}
+
+func TestPlainOutput(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- data
+	}()
+
+	// stdin is a terminal but stdout is redirected
+	rl, in := newTestInstance(t, &Config{
+		Prompt:         "> ",
+		Stdout:         w,
+		FuncIsTerminal: func() bool { return true },
+	})
+	go in.Write([]byte("hel\tlo\x12x\r"))
+	expectLine(t, rl, "hellox")
+
+	w.Close()
+	if data := <-out; bytes.ContainsRune(data, '\033') || bytes.ContainsRune(data, CharBell) {
+		t.Fatalf("unexpected output %q", data)
+	}
+}
+
+func TestMoveCursor(t *testing.T) {
+	rl, _ := newTestInstance(t, &Config{})
+	rl.Insert("hello big world")
+
+	moves := []struct {
+		move   func()
+		expect int
+	}{
+		{rl.MoveWordLeft, 10},
+		{rl.MoveWordLeft, 6},
+		{rl.MoveWordRight, 10},
+		{func() { rl.MoveCursor(-3) }, 7},
+		{func() { rl.MoveCursor(-100) }, 0},
+		{rl.MoveWordRight, 6},
+		{func() { rl.MoveCursor(100) }, 15},
+		{rl.MoveToLineStart, 0},
+		{rl.MoveToLineEnd, 15},
+	}
+	for i, m := range moves {
+		m.move()
+		if pos := rl.Operation.buf.Pos(); pos != m.expect {
+			t.Fatalf("move %d: expected %d, got %d", i, m.expect, pos)
+		}
+	}
+}
+
+func TestSmartBackspaceIndent(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{SmartBackspaceIndent: 4})
+	go func() {
+		w.Write([]byte("        \x7fx\r"))
+		w.Write([]byte("      \x7fx\r"))
+		w.Write([]byte("    ab\x7f\r"))
+		w.Write([]byte("  a  \x7f\r"))
+	}()
+	expectLine(t, rl, "    x")
+	expectLine(t, rl, "    x")
+	expectLine(t, rl, "    a")
+	expectLine(t, rl, "  a ")
+}
+
+func TestAutoCloseBrackets(t *testing.T) {
+	var mu sync.Mutex
+	var pos []int
+	cfg := &Config{AutoCloseBrackets: true}
+	cfg.SetListener(func(line []rune, p int, key rune) ([]rune, int, bool) {
+		if key == '(' || key == ')' {
+			mu.Lock()
+			pos = append(pos, p)
+			mu.Unlock()
+		}
+		return nil, 0, false
+	})
+	rl, w := newTestInstance(t, cfg)
+	go w.Write([]byte("f(x)\ra[\x7fb \"c\" don't\r"))
+	expectLine(t, rl, "f(x)")
+	expectLine(t, rl, "ab \"c\" don't")
+
+	mu.Lock()
+	defer mu.Unlock()
+	// inside the pair, then over the closing rune
+	if len(pos) != 2 || pos[0] != 2 || pos[1] != 4 {
+		t.Fatalf("unexpected cursor positions %v", pos)
+	}
+}
+
+func TestBackspaceAndDelete(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	go func() {
+		w.Write([]byte("abc\x7f\x08\r"))
+		w.Write([]byte("abc\x01\033[3~\r"))
+		// the Delete key on an empty line is not EOF
+		w.Write([]byte("\033[3~x\r"))
+	}()
+	expectLine(t, rl, "a")
+	expectLine(t, rl, "bc")
+	expectLine(t, rl, "x")
+
+	rl, w = newTestInstance(t, &Config{BackspaceIsDelete: true})
+	go w.Write([]byte("abc\x01\x7f\x05\x08\r"))
+	expectLine(t, rl, "b")
+}
+
+func TestQuotedInsert(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	go w.Write([]byte("a\x16\033b\x16\t\x16\r\r"))
+
+	expectLine(t, rl, "a\033b\t\r")
+}
+
+func TestTrimTrailingSpace(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{TrimTrailingSpace: true})
+	go w.Write([]byte("ls  \r\x10\r"))
+	expectLine(t, rl, "ls")
+	// the history has the trimmed line
+	expectLine(t, rl, "ls")
+
+	cfg := rl.GenPasswordConfig()
+	cfg.TrimTrailingSpace = true
+	go w.Write([]byte("pw  \r"))
+	pswd, err := rl.ReadPasswordWithConfig(cfg)
+	if err != nil || string(pswd) != "pw  " {
+		t.Fatalf("unexpected password %q, %v", pswd, err)
+	}
+}
+
+func TestAcceptLine(t *testing.T) {
+	var rl *Instance
+	cfg := &Config{}
+	cfg.SetListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+		if key == MetaKey('x') {
+			rl.AcceptLine()
+		}
+		return nil, 0, false
+	})
+	rl, w := newTestInstance(t, cfg)
+	go w.Write([]byte("ls -l\033x"))
+	expectLine(t, rl, "ls -l")
+
+	// the accepted line is in the history
+	go w.Write([]byte("\x10\r"))
+	expectLine(t, rl, "ls -l")
+
+	// not for the next call
+	rl.AcceptLine()
+	time.Sleep(10 * time.Millisecond)
+	go w.Write([]byte("pwd\r"))
+	expectLine(t, rl, "pwd")
+}
+
+func TestDefaultWidth(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete: NewPrefixCompleter(PcItem("hello"), PcItem("world")),
+		FuncGetWidth: func() int { return 0 },
+		DefaultWidth: 80,
+	})
+	go w.Write([]byte("he\t\r"))
+	expectLine(t, rl, "hello ")
+}
+
+func TestSanitizePaste(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{SanitizePaste: true})
+	// a paste arrives at once, Ctrl-A doesn't move to the line start
+	go w.Write([]byte("echo hello\x01 world\tagain\r"))
+	expectLine(t, rl, "echo hello world\tagain")
+
+	// typed keys still work
+	go w.Write([]byte("bc\x01a\r"))
+	expectLine(t, rl, "abc")
+}
+
+func TestAbort(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:   NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+		Stdout:         out,
+		FuncIsTerminal: func() bool { return true },
+	})
+	rl.SaveHistory("hello")
+
+	// Ctrl-G cancels the search, restoring the line
+	go w.Write([]byte("abc\x12hel\x07\r"))
+	expectLine(t, rl, "abc")
+	if n := strings.Count(out.String(), "\a"); n != 1 {
+		t.Fatalf("expected the bell once, got %d", n)
+	}
+
+	// and the candidate selection
+	go w.Write([]byte("he\t\t\t\x07\r"))
+	expectLine(t, rl, "he")
+}
+
+func TestReadBlock(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	go func() {
+		w.Write([]byte("[server]\rport = 8x\x7f0\r\r.\r"))
+		w.Write([]byte("last\r\x04"))
+	}()
+	block, err := rl.ReadBlock(".")
+	if err != nil || block != "[server]\nport = 80\n" {
+		t.Fatalf("unexpected block %q, %v", block, err)
+	}
+
+	// Ctrl-D ends the block too
+	block, err = rl.ReadBlock(".")
+	if err != nil || block != "last" {
+		t.Fatalf("unexpected block %q, %v", block, err)
+	}
+
+	go w.Write([]byte("\x04"))
+	if _, err := rl.ReadBlock("."); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestTranscriptWriter(t *testing.T) {
+	transcript := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{Prompt: "> ", TranscriptWriter: transcript})
+	go w.Write([]byte("ls\rcd  x\x7f/tmp\r"))
+	expectLine(t, rl, "ls")
+	rl.SetPrompt("$ ")
+	expectLine(t, rl, "cd  /tmp")
+
+	go w.Write([]byte("secret\r"))
+	if _, err := rl.ReadPassword("password: "); err != nil {
+		t.Fatal(err)
+	}
+	expected := "> ls\n$ cd  /tmp\npassword: \n"
+	if transcript.String() != expected {
+		t.Fatalf("unexpected transcript %q", transcript.String())
+	}
+}
+
+func TestLastKeyBytes(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		recorded []byte
+	)
+	cfg := &Config{}
+	rl, w := newTestInstance(t, cfg)
+	if b := rl.LastKeyBytes(); b != nil {
+		t.Fatalf("unexpected bytes before any key %q", b)
+	}
+	cfg.SetListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+		if key == CharBackward {
+			mu.Lock()
+			recorded = rl.LastKeyBytes()
+			mu.Unlock()
+		}
+		return nil, 0, false
+	})
+	go w.Write([]byte("ab\033[Dc\r"))
+	expectLine(t, rl, "acb")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if string(recorded) != "\033[D" {
+		t.Fatalf("unexpected bytes of the left arrow %q", recorded)
+	}
+	if b := rl.LastKeyBytes(); string(b) != "\r" {
+		t.Fatalf("unexpected bytes of the last key %q", b)
+	}
+}
+
+func TestFuncStatusPrompt(t *testing.T) {
+	transcript := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{
+		Prompt: "> ",
+		FuncStatusPrompt: func(ok bool) string {
+			if ok {
+				return "\033[32m$\033[0m "
+			}
+			return "\033[31m$\033[0m "
+		},
+		TranscriptWriter: transcript,
+	})
+	go w.Write([]byte("true\r"))
+	expectLine(t, rl, "true")
+	rl.SetPromptStatus(false)
+	go w.Write([]byte("false\r"))
+	expectLine(t, rl, "false")
+	rl.SetPromptStatus(true)
+	go w.Write([]byte("ls\r"))
+	expectLine(t, rl, "ls")
+
+	expected := "\033[32m$\033[0m true\n\033[31m$\033[0m false\n\033[32m$\033[0m ls\n"
+	if transcript.String() != expected {
+		t.Fatalf("unexpected transcript %q", transcript.String())
+	}
+}
+
+func TestNoNewlineOnAccept(t *testing.T) {
+	for _, noNewline := range []bool{false, true} {
+		out := &lockedBuffer{}
+		rl, w := newTestInstance(t, &Config{
+			Prompt:            "> ",
+			Stdout:            out,
+			FuncIsTerminal:    func() bool { return true },
+			NoNewlineOnAccept: noNewline,
+		})
+		go w.Write([]byte("ab\x01\r"))
+		expectLine(t, rl, "ab")
+		output := out.String()
+		if strings.Contains(output, "\n") != !noNewline {
+			t.Fatalf("unexpected output %q", output)
+		}
+		// the cursor was moved to the end of the line
+		if noNewline && !strings.HasSuffix(output, "> ab") {
+			t.Fatalf("unexpected output %q", output)
+		}
+	}
+}
+
+func TestSetBuffer(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{})
+	rl.SetBuffer("foo()", 4)
+	go w.Write([]byte("x\r"))
+	expectLine(t, rl, "foo(x)")
+
+	// the cursor is clamped to the line
+	rl.SetBuffer("ab", 10)
+	go w.Write([]byte("c\r"))
+	expectLine(t, rl, "abc")
+	rl.SetBuffer("ab", -1)
+	go w.Write([]byte("c\r"))
+	expectLine(t, rl, "cab")
+}
+
+func TestOnTick(t *testing.T) {
+	ticks := make(chan time.Time)
+	var interval time.Duration
+	var count int32
+	var rl *Instance
+	rl, w := newTestInstance(t, &Config{
+		Prompt:       "| ",
+		TickInterval: 100 * time.Millisecond,
+		OnTick: func() {
+			n := atomic.AddInt32(&count, 1)
+			rl.SetPrompt(`|/-\`[n%4:n%4+1] + " ")
+		},
+		funcNewTicker: func(d time.Duration) (<-chan time.Time, func()) {
+			interval = d
+			return ticks, func() {}
+		},
+	})
+	result := make(chan string)
+	go func() {
+		line, _ := rl.Readline()
+		result <- line
+	}()
+	// once the key is read, Readline is waiting for the next ones
+	w.Write([]byte("a"))
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now()
+	}
+	w.Write([]byte("b\r"))
+	if line := <-result; line != "ab" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if n := atomic.LoadInt32(&count); n != 3 {
+		t.Fatalf("expected 3 ticks, got %d", n)
+	}
+	if interval != 100*time.Millisecond {
+		t.Fatalf("unexpected interval %v", interval)
+	}
+}
+
+func TestFlashMessage(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	timer := make(chan time.Time)
+	var duration time.Duration
+	typed := make(chan struct{})
+	rl, w := newTestInstance(t, &Config{
+		Prompt: "> ",
+		Stdout: out,
+		Listener: FuncListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+			if key == 'b' {
+				typed <- struct{}{}
+			}
+			return nil, 0, false
+		}),
+		FuncIsTerminal: func() bool { return true },
+		funcNewTimer: func(d time.Duration) (<-chan time.Time, func()) {
+			duration = d
+			return timer, func() {}
+		},
+	})
+	result := make(chan string)
+	go func() {
+		line, _ := rl.Readline()
+		result <- line
+	}()
+	go w.Write([]byte("ab"))
+	<-typed
+	rl.FlashMessage("Copied!", time.Second)
+	// once the timer is taken, the message was shown
+	timer <- time.Now()
+	w.Write([]byte("\r"))
+	if line := <-result; line != "ab" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if duration != time.Second {
+		t.Fatalf("unexpected duration %v", duration)
+	}
+
+	output := out.String()
+	i := strings.Index(output, "\n\033[JCopied!\033[1A\r\033[4C")
+	if i < 0 {
+		t.Fatalf("the message isn't shown: %q", output)
+	}
+	// the line is drawn again without it
+	if !strings.Contains(output[i:], "\033[J") || !strings.Contains(output[i:], "> ab") {
+		t.Fatalf("the message isn't cleared: %q", output[i:])
+	}
+}
+
+func TestSize(t *testing.T) {
+	rl, _ := newTestInstance(t, &Config{
+		FuncGetWidth:  func() int { return 120 },
+		FuncGetHeight: func() int { return 40 },
+	})
+	if cols, rows := rl.Size(); cols != 120 || rows != 40 {
+		t.Fatalf("unexpected size %dx%d", cols, rows)
+	}
+
+	// not a terminal
+	rl, _ = newTestInstance(t, &Config{
+		FuncGetWidth:  func() int { return -1 },
+		FuncGetHeight: func() int { return -1 },
+	})
+	if cols, rows := rl.Size(); cols != 80 || rows != 24 {
+		t.Fatalf("unexpected size %dx%d", cols, rows)
+	}
+}
+
+func TestCompletionTimeout(t *testing.T) {
+	timeout := make(chan time.Time)
+	var started int32
+	rl, w := newTestInstance(t, &Config{
+		AutoComplete:      NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+		FuncIsTerminal:    func() bool { return true },
+		CompletionTimeout: time.Second,
+		funcNewTimer: func(d time.Duration) (<-chan time.Time, func()) {
+			atomic.AddInt32(&started, 1)
+			return timeout, func() {}
+		},
+	})
+	result := make(chan string)
+	go func() {
+		line, _ := rl.Readline()
+		result <- line
+	}()
+	// the timer only runs while the candidates are shown
+	w.Write([]byte("he\t"))
+	timeout <- time.Now()
+
+	// they're hidden: Tab shows them again rather than selecting one
+	w.Write([]byte("\t\r"))
+	if line := <-result; line != "he" {
+		t.Fatalf("unexpected line %q", line)
+	}
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Fatalf("the timer should start twice, got %d", n)
+	}
+}
+
+func TestIgnoreEmptyLine(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{IgnoreEmptyLine: true, TrimTrailingSpace: true})
+	go w.Write([]byte("\r  \rls\r"))
+	expectLine(t, rl, "ls")
+
+	// an empty password is still accepted
+	go w.Write([]byte("\r"))
+	pswd, err := rl.ReadPassword("password: ")
+	if err != nil || len(pswd) != 0 {
+		t.Fatalf("unexpected password %q, %v", pswd, err)
+	}
+}
+
+func TestRawModeHooks(t *testing.T) {
+	var m sync.Mutex
+	var events []string
+	record := func(e string) {
+		m.Lock()
+		events = append(events, e)
+		m.Unlock()
+	}
+	cfg := &Config{
+		OnEnterRawMode: func() { record("enter") },
+		OnExitRawMode:  func() { record("exit") },
+	}
+	cfg.SetListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+		// Enter is seen once the line is returned
+		if key != 0 && key != CharEnter {
+			record(string(key))
+		}
+		return nil, 0, false
+	})
+	rl, w := newTestInstance(t, cfg)
+	go w.Write([]byte("a\r"))
+	expectLine(t, rl, "a")
+
+	m.Lock()
+	defer m.Unlock()
+	if got := strings.Join(events, ","); got != "enter,a,exit" {
+		t.Fatalf("unexpected events %q", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	tabbed := make(chan struct{}, 1)
+	cfg := &Config{
+		AutoComplete:   NewPrefixCompleter(PcItem("hello"), PcItem("help")),
+		FuncIsTerminal: func() bool { return true },
+	}
+	cfg.SetListener(func(line []rune, pos int, key rune) ([]rune, int, bool) {
+		if key == CharTab {
+			tabbed <- struct{}{}
+		}
+		return nil, 0, false
+	})
+	rl, w := newTestInstance(t, cfg)
+	result := make(chan string)
+	go func() {
+		line, _ := rl.Readline()
+		result <- line
+	}()
+	w.Write([]byte("he\t"))
+	<-tabbed
+	rl.Reset()
+	// the candidates are shown again rather than selected
+	w.Write([]byte("\t\r"))
+	<-tabbed
+	if line := <-result; line != "he" {
+		t.Fatalf("unexpected line %q", line)
+	}
+
+	// the cut buffer is emptied
+	go w.Write([]byte("ab\x15\r"))
+	expectLine(t, rl, "")
+	rl.Reset()
+	go w.Write([]byte("\x19\r"))
+	expectLine(t, rl, "")
+}
+
+func TestVimInsertModeKeys(t *testing.T) {
+	var rl *Instance
+	rl, w := newTestInstance(t, &Config{
+		VimMode: true,
+		FuncFilterInputRune: func(r rune) (rune, bool) {
+			// Ctrl-X goes to the line start in insert mode only
+			if r == 24 && rl.IsVimInsertMode() {
+				return CharLineStart, true
+			}
+			return r, true
+		},
+	})
+	go w.Write([]byte("bc\x01a\r"))
+	expectLine(t, rl, "abc")
+	go w.Write([]byte("bc\x18a\r"))
+	expectLine(t, rl, "abc")
+
+	// not bound in normal mode
+	go w.Write([]byte("xy\033\x18\r"))
+	expectLine(t, rl, "xy")
+}
+
+func TestKeyMaps(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{
+		VimMode: true,
+		// Ctrl-A is kept from the emacs shortcuts but not Ctrl-E
+		VimInsertKeyMap: KeyMap{CharLineStart: CharLineStart, CharLineEnd: 0},
+		VimNormalKeyMap: KeyMap{'H': '0'},
+	})
+	go w.Write([]byte("bc\x01a\r"))
+	expectLine(t, rl, "abc")
+	go w.Write([]byte("bc\x01\x05a\r"))
+	expectLine(t, rl, "abc")
+	go w.Write([]byte("bc\033Hia\r"))
+	expectLine(t, rl, "abc")
+
+	rl, w = newTestInstance(t, &Config{
+		EmacsKeyMap:     KeyMap{CharLineStart: CharLineEnd},
+		VimInsertKeyMap: KeyMap{CharLineStart: 0},
+	})
+	go w.Write([]byte("bc\x01\x02a\x05\r"))
+	expectLine(t, rl, "bac")
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 )
 
 type runeBufferBck struct {
@@ -20,6 +21,10 @@ type RuneBuffer struct {
 	prompt []rune
 	w      io.Writer
 
+	// promptWidth is the visible width of prompt, which excludes the
+	// parts wrapped in \001...\002.
+	promptWidth int
+
 	hadClean    bool
 	interactive bool
 	cfg         *Config
@@ -39,6 +44,20 @@ func (r *RuneBuffer) pushKill(text []rune) {
 	r.lastKill = append([]rune{}, text...)
 }
 
+// KillBuffer returns the text which was cut last.
+func (r *RuneBuffer) KillBuffer() []rune {
+	r.Lock()
+	defer r.Unlock()
+	return runes.Copy(r.lastKill)
+}
+
+// SetKillBuffer replaces the text which will be pasted by Yank.
+func (r *RuneBuffer) SetKillBuffer(text []rune) {
+	r.Lock()
+	r.pushKill(text)
+	r.Unlock()
+}
+
 func (r *RuneBuffer) OnWidthChange(newWidth int) {
 	r.Lock()
 	r.width = newWidth
@@ -88,7 +107,14 @@ func (r *RuneBuffer) SetMask(m rune) {
 func (r *RuneBuffer) CurrentWidth(x int) int {
 	r.Lock()
 	defer r.Unlock()
-	return runes.WidthAll(r.buf[:x])
+	return r.cfg.widthAll(r.buf[:x])
+}
+
+// Prompt returns the prompt as printed, without the \001 and \002 markers.
+func (r *RuneBuffer) Prompt() string {
+	r.Lock()
+	defer r.Unlock()
+	return string(r.prompt)
 }
 
 func (r *RuneBuffer) PromptLen() int {
@@ -99,7 +125,7 @@ func (r *RuneBuffer) PromptLen() int {
 }
 
 func (r *RuneBuffer) promptLen() int {
-	return runes.WidthAll(runes.ColorFilter(r.prompt))
+	return r.promptWidth
 }
 
 func (r *RuneBuffer) RuneSlice(i int) []rune {
@@ -145,6 +171,84 @@ func (r *RuneBuffer) MoveToLineStart() {
 	})
 }
 
+// MoveToCurrentLineStart moves the cursor to the start of its line when
+// the buffer holds several ones, and to the start of the buffer if it's
+// already there (e.g. Ctrl-A twice).
+func (r *RuneBuffer) MoveToCurrentLineStart() {
+	r.Refresh(func() {
+		start := lineStartIndex(r.buf, r.idx)
+		if start == r.idx {
+			start = 0
+		}
+		r.idx = start
+	})
+}
+
+// MoveToCurrentLineEnd is MoveToCurrentLineStart for the line end.
+func (r *RuneBuffer) MoveToCurrentLineEnd() {
+	r.Refresh(func() {
+		end := lineEndIndex(r.buf, r.idx)
+		if end == r.idx {
+			end = len(r.buf)
+		}
+		r.idx = end
+	})
+}
+
+// MoveToPrevLine moves the cursor to the line above in a buffer holding
+// several ones, keeping its column if the line is long enough. It reports
+// false if the cursor is on the first line.
+func (r *RuneBuffer) MoveToPrevLine() (moved bool) {
+	r.Refresh(func() {
+		start := lineStartIndex(r.buf, r.idx)
+		if start == 0 {
+			return
+		}
+		prevStart := lineStartIndex(r.buf, start-1)
+		col := r.idx - start
+		if max := start - 1 - prevStart; col > max {
+			col = max
+		}
+		r.idx = prevStart + col
+		moved = true
+	})
+	return
+}
+
+// MoveToNextLine is MoveToPrevLine for the line below.
+func (r *RuneBuffer) MoveToNextLine() (moved bool) {
+	r.Refresh(func() {
+		end := lineEndIndex(r.buf, r.idx)
+		if end == len(r.buf) {
+			return
+		}
+		col := r.idx - lineStartIndex(r.buf, r.idx)
+		if max := lineEndIndex(r.buf, end+1) - (end + 1); col > max {
+			col = max
+		}
+		r.idx = end + 1 + col
+		moved = true
+	})
+	return
+}
+
+// lineStartIndex returns the start of the line of buf holding idx.
+func lineStartIndex(buf []rune, idx int) int {
+	for idx > 0 && buf[idx-1] != '\n' {
+		idx--
+	}
+	return idx
+}
+
+// lineEndIndex returns the end of the line of buf holding idx, where its
+// newline is.
+func lineEndIndex(buf []rune, idx int) int {
+	for idx < len(buf) && buf[idx] != '\n' {
+		idx++
+	}
+	return idx
+}
+
 func (r *RuneBuffer) MoveBackward() {
 	r.Refresh(func() {
 		if r.idx == 0 {
@@ -154,6 +258,19 @@ func (r *RuneBuffer) MoveBackward() {
 	})
 }
 
+// MoveCursor moves the cursor by delta runes, staying within the line.
+func (r *RuneBuffer) MoveCursor(delta int) {
+	r.Refresh(func() {
+		idx := r.idx + delta
+		if idx < 0 {
+			idx = 0
+		} else if idx > len(r.buf) {
+			idx = len(r.buf)
+		}
+		r.idx = idx
+	})
+}
+
 func (r *RuneBuffer) WriteString(s string) {
 	r.WriteRunes([]rune(s))
 }
@@ -170,6 +287,40 @@ func (r *RuneBuffer) WriteRunes(s []rune) {
 	})
 }
 
+// WritePair writes open and close, leaving the cursor between them.
+func (r *RuneBuffer) WritePair(open, close rune) {
+	r.Refresh(func() {
+		tail := append([]rune{open, close}, r.buf[r.idx:]...)
+		r.buf = append(r.buf[:r.idx], tail...)
+		r.idx++
+	})
+}
+
+// RunesAround returns the runes before and after the cursor, 0 at the
+// ends of the line.
+func (r *RuneBuffer) RunesAround() (before, after rune) {
+	r.Lock()
+	defer r.Unlock()
+	if r.idx > 0 {
+		before = r.buf[r.idx-1]
+	}
+	if r.idx < len(r.buf) {
+		after = r.buf[r.idx]
+	}
+	return
+}
+
+// DeletePair deletes the runes before and after the cursor.
+func (r *RuneBuffer) DeletePair() {
+	r.Refresh(func() {
+		if r.idx == 0 || r.idx >= len(r.buf) {
+			return
+		}
+		r.idx--
+		r.buf = append(r.buf[:r.idx], r.buf[r.idx+2:]...)
+	})
+}
+
 func (r *RuneBuffer) MoveForward() {
 	r.Refresh(func() {
 		if r.idx == len(r.buf) {
@@ -271,6 +422,78 @@ func (r *RuneBuffer) Kill() {
 	})
 }
 
+// KillWholeLine cuts the whole line regardless of the cursor position.
+func (r *RuneBuffer) KillWholeLine() {
+	r.Refresh(func() {
+		r.pushKill(r.buf)
+		r.buf = r.buf[:0]
+		r.idx = 0
+	})
+}
+
+// DeleteToMatchingBracket cuts from the cursor to the bracket matching the
+// first one at or after the cursor, both included, like d% in vim. If that
+// bracket closes a pair, the cut starts at the one opening it instead. It
+// reports false and leaves the line as it is if there is no bracket or it
+// isn't matched.
+func (r *RuneBuffer) DeleteToMatchingBracket() (success bool) {
+	r.Refresh(func() {
+		pos := r.idx
+		for pos < len(r.buf) && !strings.ContainsRune("()[]{}", r.buf[pos]) {
+			pos++
+		}
+		if pos == len(r.buf) {
+			return
+		}
+		match := matchingBracket(r.buf, pos)
+		if match < 0 {
+			return
+		}
+		start, end := r.idx, match+1
+		if match < pos {
+			start, end = match, pos+1
+		}
+		r.pushKill(r.buf[start:end])
+		r.buf = append(r.buf[:start], r.buf[end:]...)
+		r.idx = start
+		success = true
+	})
+	return
+}
+
+// matchingBracket returns the index of the bracket matching the one at pos
+// in rs, -1 if it's unbalanced.
+func matchingBracket(rs []rune, pos int) int {
+	open, close, step := rs[pos], rs[pos], 1
+	switch rs[pos] {
+	case '(':
+		close = ')'
+	case '[':
+		close = ']'
+	case '{':
+		close = '}'
+	case ')':
+		open, step = '(', -1
+	case ']':
+		open, step = '[', -1
+	case '}':
+		open, step = '{', -1
+	}
+	depth := 0
+	for i := pos; i >= 0 && i < len(rs); i += step {
+		switch rs[i] {
+		case open:
+			depth += step
+		case close:
+			depth -= step
+		}
+		if depth == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
 func (r *RuneBuffer) Transpose() {
 	r.Refresh(func() {
 		if len(r.buf) == 1 {
@@ -326,27 +549,49 @@ func (r *RuneBuffer) MoveToEndWord() {
 	})
 }
 
+// BackEscapeWord cuts the word before the cursor, a run of punctuation
+// counts as a word on its own (Meta-Backspace).
 func (r *RuneBuffer) BackEscapeWord() {
+	r.killBackTo(func(a, b rune) bool {
+		return IsWordBreak(a) == IsWordBreak(b)
+	})
+}
+
+// UnixWordRubout cuts back to the previous whitespace (Ctrl-W).
+func (r *RuneBuffer) UnixWordRubout() {
+	r.killBackTo(func(a, b rune) bool {
+		return true
+	})
+}
+
+// killBackTo skips the spaces before the cursor then cuts back while
+// the runes are in the same word as the rune before the cursor.
+func (r *RuneBuffer) killBackTo(sameWord func(a, b rune) bool) {
 	r.Refresh(func() {
-		if r.idx == 0 {
-			return
+		i := r.idx
+		for i > 0 && unicode.IsSpace(r.buf[i-1]) {
+			i--
 		}
-		for i := r.idx - 1; i > 0; i-- {
-			if !IsWordBreak(r.buf[i]) && IsWordBreak(r.buf[i-1]) {
-				r.pushKill(r.buf[i:r.idx])
-				r.buf = append(r.buf[:i], r.buf[r.idx:]...)
-				r.idx = i
-				return
+		if i > 0 {
+			last := r.buf[i-1]
+			for i > 0 && !unicode.IsSpace(r.buf[i-1]) && sameWord(r.buf[i-1], last) {
+				i--
 			}
 		}
-
-		r.buf = r.buf[:0]
-		r.idx = 0
+		if i == r.idx {
+			return
+		}
+		r.pushKill(r.buf[i:r.idx])
+		r.buf = append(r.buf[:i], r.buf[r.idx:]...)
+		r.idx = i
 	})
 }
 
 func (r *RuneBuffer) Yank() {
-	if len(r.lastKill) == 0 {
+	r.Lock()
+	empty := len(r.lastKill) == 0
+	r.Unlock()
+	if empty {
 		return
 	}
 	r.Refresh(func() {
@@ -370,6 +615,54 @@ func (r *RuneBuffer) Backspace() {
 	})
 }
 
+// BackspaceIndent deletes the spaces back to the previous indentation
+// stop (a multiple of width) if there are only spaces before the cursor,
+// the previous character otherwise.
+func (r *RuneBuffer) BackspaceIndent(width int) {
+	r.Refresh(func() {
+		if r.idx == 0 {
+			return
+		}
+
+		n := 1
+		if width > 0 && isIndent(r.buf[:r.idx]) {
+			n = (r.idx-1)%width + 1
+		}
+		r.idx -= n
+		r.buf = append(r.buf[:r.idx], r.buf[r.idx+n:]...)
+	})
+}
+
+func isIndent(rs []rune) bool {
+	for _, r := range rs {
+		if r != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// ReplaceRange replaces the runes from start to end with text and moves
+// the cursor after it.
+func (r *RuneBuffer) ReplaceRange(start, end int, text []rune) {
+	r.Refresh(func() {
+		if end > len(r.buf) {
+			end = len(r.buf)
+		}
+		if start < 0 {
+			start = 0
+		} else if start > end {
+			start = end
+		}
+		buf := make([]rune, 0, len(r.buf)-(end-start)+len(text))
+		buf = append(buf, r.buf[:start]...)
+		buf = append(buf, text...)
+		buf = append(buf, r.buf[end:]...)
+		r.buf = buf
+		r.idx = start + len(text)
+	})
+}
+
 func (r *RuneBuffer) Backspaces(n int) {
 	if n <= 0 {
 		return
@@ -403,8 +696,12 @@ func (r *RuneBuffer) LineCount(width int) int {
 	if width == -1 {
 		width = r.width
 	}
+	if r.isWrapped(width) {
+		cells := r.wrapCells(width)
+		return cells[len(r.buf)].row + 1
+	}
 	return LineCount(width,
-		runes.WidthAll(r.buf)+r.PromptLen())
+		r.cfg.widthAll(r.buf)+r.PromptLen())
 }
 
 func (r *RuneBuffer) MoveTo(ch rune, prevChar, reverse bool) (success bool) {
@@ -445,7 +742,7 @@ func (r *RuneBuffer) isInLineEdge() bool {
 }
 
 func (r *RuneBuffer) getSplitByLine(rs []rune) []string {
-	return SplitByLine(r.promptLen(), r.width, rs)
+	return splitByLine(r.promptLen(), r.width, rs, r.cfg.runeWidth)
 }
 
 func (r *RuneBuffer) IdxLine(width int) int {
@@ -458,6 +755,9 @@ func (r *RuneBuffer) idxLine(width int) int {
 	if width == 0 {
 		return 0
 	}
+	if r.isWrapped(width) {
+		return r.wrapCells(width)[r.idx].row
+	}
 	sp := r.getSplitByLine(r.buf[:r.idx])
 	return len(sp) - 1
 }
@@ -496,6 +796,9 @@ func (r *RuneBuffer) print() {
 }
 
 func (r *RuneBuffer) output() []byte {
+	if r.isWrapped(r.width) {
+		return r.wrapOutput()
+	}
 	buf := bytes.NewBuffer(nil)
 	buf.WriteString(string(r.prompt))
 	if r.cfg.EnableMask && len(r.buf) > 0 {
@@ -528,21 +831,166 @@ func (r *RuneBuffer) output() []byte {
 	return buf.Bytes()
 }
 
-func (r *RuneBuffer) getBackspaceSequence() []byte {
-	var sep = map[int]bool{}
+// isWrapped reports whether the line wraps at explicit points rather than
+// relying on the terminal, it's enabled by Config.WrapIndicator.
+func (r *RuneBuffer) isWrapped(width int) bool {
+	return r.cfg.WrapIndicator != 0 && width > 1
+}
+
+type wrapCell struct {
+	row, col int
+}
+
+// wrapCells returns the screen position of each rune of the line and of the
+// end of the line, a row holds width-1 columns and the last one is left for
+// the WrapIndicator. The line starts where the terminal left the prompt.
+func (r *RuneBuffer) wrapCells(width int) []wrapCell {
+	cells := make([]wrapCell, len(r.buf)+1)
+	row, col := r.promptLen()/width, r.promptLen()%width
+	for i, e := range r.buf {
+		w := r.wrapRuneWidth(e, width)
+		if e != '\n' && col > 0 && col+w > width-1 {
+			row, col = row+1, 0
+		}
+		cells[i] = wrapCell{row, col}
+		if e == '\n' {
+			row, col = row+1, 0
+		} else {
+			col += w
+		}
+	}
+	cells[len(r.buf)] = wrapCell{row, col}
+	return cells
+}
+
+// runeWidth returns the columns taken by e on the screen.
+func (r *RuneBuffer) runeWidth(e rune) int {
+	switch {
+	case r.cfg.EnableMask:
+		return r.cfg.runeWidth(r.cfg.MaskRune)
+	case e == '\t':
+		return TabWidth
+	}
+	return r.cfg.runeWidth(e)
+}
+
+// wrapRuneWidth returns the columns taken by e on a row of the given width,
+// a tab wider than the row is shortened to fit.
+func (r *RuneBuffer) wrapRuneWidth(e rune, width int) int {
+	if w := r.runeWidth(e); w < width {
+		return w
+	}
+	return width
+}
+
+// wrapOutput writes each row of the line on its own, the rows broken by
+// wrapping end with the WrapIndicator in the last column unless a rune
+// wider than width-1 fills them.
+func (r *RuneBuffer) wrapOutput() []byte {
+	cells := r.wrapCells(r.width)
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString(string(r.prompt))
+	promptLen := r.promptLen()
+	if promptLen > 0 && promptLen%r.width == 0 {
+		// the prompt ends on the edge, move the cursor to the next row
+		buf.WriteString(" \b")
+	}
 
-	var i int
-	for {
-		if i >= runes.WidthAll(r.buf) {
+	start, last := 0, cells[len(r.buf)].row
+	for row, col := promptLen/r.width, promptLen%r.width; ; row++ {
+		end := start
+		for end < len(r.buf) && cells[end].row == row {
+			end++
+		}
+		hardBreak := end > start && r.buf[end-1] == '\n'
+		if hardBreak {
+			r.writeRow(buf, start, end-1)
+		} else if end > start {
+			r.writeRow(buf, start, end)
+			col = cells[end-1].col + r.wrapRuneWidth(r.buf[end-1], r.width)
+		}
+		if row == last {
 			break
 		}
+		if !hardBreak && col <= r.width-1 {
+			buf.WriteString(strings.Repeat(" ", r.width-1-col))
+			buf.WriteRune(r.cfg.WrapIndicator)
+		}
+		buf.WriteString("\r\n")
+		start = end
+	}
+
+	// move the cursor back from the end of the line
+	cursor := cells[r.idx]
+	if up := last - cursor.row; up > 0 {
+		buf.WriteString("\033[" + strconv.Itoa(up) + "A")
+	}
+	if cells[len(r.buf)] != cursor {
+		buf.WriteString("\r")
+		if cursor.col > 0 {
+			buf.WriteString("\033[" + strconv.Itoa(cursor.col) + "C")
+		}
+	}
+	return buf.Bytes()
+}
 
-		if i == 0 {
-			i -= r.promptLen()
+// writeRow writes the runes of the line from start to end as they are shown,
+// the Painter paints each row on its own.
+func (r *RuneBuffer) writeRow(buf *bytes.Buffer, start, end int) {
+	if r.cfg.EnableMask {
+		buf.WriteString(strings.Repeat(string(r.cfg.MaskRune), end-start))
+		return
+	}
+	pos := r.idx - start
+	if pos < 0 {
+		pos = 0
+	} else if pos > end-start {
+		pos = end - start
+	}
+	for _, e := range r.cfg.Painter.Paint(r.buf[start:end], pos) {
+		if e == '\t' {
+			buf.WriteString(strings.Repeat(" ", r.wrapRuneWidth(e, r.width)))
+		} else {
+			buf.WriteRune(e)
 		}
-		i += r.width
+	}
+}
+
+// Render returns the bytes written to the terminal for showing line with
+// the cursor at pos: the prompt of cfg, the line and the cursor positioning
+// for a terminal of the given width. It's meant for testing how a prompt
+// renders without a terminal.
+func Render(cfg *Config, line []rune, pos int, width int) []byte {
+	c := *cfg
+	if c.Painter == nil {
+		c.Painter = &defaultPainter{}
+	}
+	if pos < 0 {
+		pos = 0
+	} else if pos > len(line) {
+		pos = len(line)
+	}
+	r := &RuneBuffer{
+		buf:   runes.Copy(line),
+		idx:   pos,
+		cfg:   &c,
+		width: width,
+	}
+	r.SetPrompt(c.Prompt)
+	return r.output()
+}
+
+func (r *RuneBuffer) getBackspaceSequence() []byte {
+	var sep = map[int]bool{}
 
-		sep[i] = true
+	// the ends of the rows, the first one shortened by the prompt
+	if width := r.cfg.widthAll(r.buf); width > 0 && r.width > 0 {
+		for i := r.width - r.promptLen(); ; i += r.width {
+			sep[i] = true
+			if i >= width {
+				break
+			}
+		}
 	}
 	var buf []byte
 	for i := len(r.buf); i > r.idx; i-- {
@@ -567,26 +1015,36 @@ func (r *RuneBuffer) Reset() []rune {
 
 func (r *RuneBuffer) calWidth(m int) int {
 	if m > 0 {
-		return runes.WidthAll(r.buf[r.idx : r.idx+m])
+		return r.cfg.widthAll(r.buf[r.idx : r.idx+m])
 	}
-	return runes.WidthAll(r.buf[r.idx+m : r.idx])
+	return r.cfg.widthAll(r.buf[r.idx+m : r.idx])
 }
 
 func (r *RuneBuffer) SetStyle(start, end int, style string) {
 	if end < start {
 		panic("end < start")
 	}
+	r.SetStyles([][2]int{{start, end}}, style)
+}
 
+// SetStyles redraws the ranges of the line, sorted and not overlapping,
+// with style.
+func (r *RuneBuffer) SetStyles(ranges [][2]int, style string) {
 	// goto start
-	move := start - r.idx
+	move := ranges[0][0] - r.idx
 	if move > 0 {
 		r.w.Write([]byte(string(r.buf[r.idx : r.idx+move])))
 	} else {
 		r.w.Write(bytes.Repeat([]byte("\b"), r.calWidth(move)))
 	}
-	r.w.Write([]byte("\033[" + style + "m"))
-	r.w.Write([]byte(string(r.buf[start:end])))
-	r.w.Write([]byte("\033[0m"))
+	for i, rg := range ranges {
+		if i > 0 {
+			r.w.Write([]byte(string(r.buf[ranges[i-1][1]:rg[0]])))
+		}
+		r.w.Write([]byte("\033[" + style + "m"))
+		r.w.Write([]byte(string(r.buf[rg[0]:rg[1]])))
+		r.w.Write([]byte("\033[0m"))
+	}
 	// TODO: move back
 }
 
@@ -603,10 +1061,35 @@ func (r *RuneBuffer) Set(buf []rune) {
 
 func (r *RuneBuffer) SetPrompt(prompt string) {
 	r.Lock()
-	r.prompt = []rune(prompt)
+	r.prompt, r.promptWidth = parsePrompt([]rune(prompt), r.cfg.widthAll)
 	r.Unlock()
 }
 
+// parsePrompt strips the \001 and \002 markers from prompt, as readline
+// does, and returns the width of the runes outside of them as measured by
+// widthAll. Whatever is wrapped in the markers is printed but takes no room
+// on the screen.
+func parsePrompt(prompt []rune, widthAll func([]rune) int) ([]rune, int) {
+	printed := make([]rune, 0, len(prompt))
+	visible := make([]rune, 0, len(prompt))
+	hidden := false
+	for _, r := range prompt {
+		switch r {
+		case '\001':
+			hidden = true
+			continue
+		case '\002':
+			hidden = false
+			continue
+		}
+		printed = append(printed, r)
+		if !hidden {
+			visible = append(visible, r)
+		}
+	}
+	return printed, widthAll(runes.StripANSI(visible))
+}
+
 func (r *RuneBuffer) cleanOutput(w io.Writer, idxLine int) {
 	buf := bufio.NewWriter(w)
 
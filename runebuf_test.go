@@ -0,0 +1,221 @@
+package readline
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRender(t *testing.T) {
+	ret := []struct {
+		line   string
+		pos    int
+		width  int
+		expect string
+	}{
+		{"hello", 5, 80, "> hello"},
+		{"hello", 3, 80, "> hello\b\b"},
+		// "> abcd" and "efgh", the cursor at the start of the second line
+		{"abcdefgh", 4, 6, "> abcdefgh\b\b\b\b"},
+	}
+	for _, r := range ret {
+		out := Render(&Config{Prompt: "> "}, []rune(r.line), r.pos, r.width)
+		if string(out) != r.expect {
+			t.Fatalf("%q at %d: unexpected output %q", r.line, r.pos, out)
+		}
+	}
+}
+
+func TestRenderNarrow(t *testing.T) {
+	// the prompt fills whole rows
+	for _, width := range []int{2, 1, 0} {
+		done := make(chan []byte)
+		go func() {
+			done <- Render(&Config{Prompt: "> "}, []rune("abc"), 1, width)
+		}()
+		select {
+		case out := <-done:
+			if !bytes.HasPrefix(out, []byte("> abc")) {
+				t.Fatalf("width %d: unexpected output %q", width, out)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("width %d: Render doesn't return", width)
+		}
+	}
+}
+
+func TestRenderInvisiblePrompt(t *testing.T) {
+	prompt := "\001\033]0;title\007\033[31m\002> \001\033[0m\002"
+	r := &RuneBuffer{cfg: &Config{}, width: 80}
+	r.SetPrompt(prompt)
+	if n := r.PromptLen(); n != 2 {
+		t.Fatalf("unexpected prompt width %d", n)
+	}
+
+	cfg := &Config{Prompt: prompt, WrapIndicator: '\\'}
+	out := string(Render(cfg, []rune("abcdefgh"), 1, 6))
+	// the cursor goes back to the column 2+1 on the first line
+	expect := "\033]0;title\007\033[31m> \033[0mabc\\\r\ndefgh\033[1A\r\033[3C"
+	if out != expect {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestRenderWrapIndicator(t *testing.T) {
+	cfg := &Config{Prompt: "> ", WrapIndicator: '\\'}
+	ret := []struct {
+		line   string
+		pos    int
+		expect string
+	}{
+		{"abc", 3, "> abc"},
+		{"abcdefgh", 8, "> abc\\\r\ndefgh"},
+		{"abcdefgh", 1, "> abc\\\r\ndefgh\033[1A\r\033[3C"},
+		{"abcdefgh", 3, "> abc\\\r\ndefgh\r"},
+		// a wide rune doesn't fit in the remaining column
+		{"ab世界", 4, "> ab \\\r\n世界"},
+		{"ab\ncd", 4, "> ab\r\ncd\r\033[1C"},
+	}
+	for _, r := range ret {
+		out := Render(cfg, []rune(r.line), r.pos, 6)
+		if string(out) != r.expect {
+			t.Fatalf("%q at %d: unexpected output %q", r.line, r.pos, out)
+		}
+	}
+}
+
+func TestRenderWrapNarrow(t *testing.T) {
+	ret := []struct {
+		prompt string
+		line   string
+		width  int
+		expect string
+	}{
+		// the tab fills the row, no room for the indicator
+		{"", "\tab", 4, "    \r\nab\033[1A\r"},
+		// the tab is cut to the width of the row
+		{"", "\ta", 2, "  \r\na\033[1A\r"},
+		{"", "a世界", 3, "a \\\r\n世\\\r\n界\033[2A\r"},
+		// the prompt is wrapped by the terminal
+		{"abcdef", "xy", 4, "abcdefx\\\r\ny\033[1A\r\033[2C"},
+		{"abcd", "xy", 4, "abcd \bxy\r"},
+	}
+	for _, r := range ret {
+		cfg := &Config{Prompt: r.prompt, WrapIndicator: '\\'}
+		out := Render(cfg, []rune(r.line), 0, r.width)
+		if string(out) != r.expect {
+			t.Fatalf("%q at width %d: unexpected output %q", r.line, r.width, out)
+		}
+	}
+
+	cfg := &Config{Prompt: "abcdef", WrapIndicator: '\\', Painter: &defaultPainter{}}
+	rb := &RuneBuffer{cfg: cfg, width: 4}
+	rb.SetPrompt(cfg.Prompt)
+	rb.buf = []rune("xy")
+	if n := rb.LineCount(4); n != 3 {
+		t.Fatalf("unexpected line count %d", n)
+	}
+}
+
+func TestRuneWidthFunc(t *testing.T) {
+	// every rune takes two columns
+	double := func(rune) int { return 2 }
+	cfg := &Config{Prompt: "> ", WrapIndicator: '\\', RuneWidthFunc: double, Painter: &defaultPainter{}}
+	r := &RuneBuffer{cfg: cfg, width: 10}
+	r.SetPrompt(cfg.Prompt)
+	r.buf = []rune("abcdef")
+	r.idx = 2
+	if n := r.PromptLen(); n != 4 {
+		t.Fatalf("unexpected prompt width %d", n)
+	}
+	if n := r.CurrentWidth(r.idx); n != 4 {
+		t.Fatalf("unexpected cursor width %d", n)
+	}
+	// the prompt and two runes fill the first row, the next one doesn't fit
+	// in front of the wrap indicator
+	if n := r.LineCount(10); n != 2 {
+		t.Fatalf("unexpected line count %d", n)
+	}
+
+	out := string(Render(cfg, []rune("abcdef"), 2, 10))
+	expect := "> ab \\\r\ncdef\r"
+	if out != expect {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestWrapIndicatorLines(t *testing.T) {
+	cfg := &Config{Prompt: "> ", WrapIndicator: '\\', Painter: &defaultPainter{}}
+	r := &RuneBuffer{cfg: cfg, width: 6}
+	r.SetPrompt(cfg.Prompt)
+	r.buf = []rune("abcdefghijk")
+	r.idx = 5
+	if n := r.LineCount(6); n != 3 {
+		t.Fatalf("unexpected line count %d", n)
+	}
+	if n := r.IdxLine(6); n != 1 {
+		t.Fatalf("unexpected cursor line %d", n)
+	}
+}
+
+func TestKillWordBack(t *testing.T) {
+	cfg := &Config{FuncIsTerminal: func() bool { return false }}
+	ret := []struct {
+		kill   func(r *RuneBuffer)
+		expect []string
+	}{
+		{(*RuneBuffer).UnixWordRubout, []string{"baz", "foo-bar "}},
+		{(*RuneBuffer).BackEscapeWord, []string{"baz", "bar ", "-", "foo"}},
+	}
+	for i, ret := range ret {
+		r := NewRuneBuffer(nil, "", cfg, 80)
+		r.Set([]rune("foo-bar baz"))
+		for _, expect := range ret.expect {
+			ret.kill(r)
+			if cut := string(r.KillBuffer()); cut != expect {
+				t.Fatalf("%d: expected to cut %q, got %q", i, expect, cut)
+			}
+		}
+		if line := string(r.Runes()); line != "" {
+			t.Fatalf("%d: unexpected line %q", i, line)
+		}
+	}
+}
+
+func TestDeleteToMatchingBracket(t *testing.T) {
+	ret := []struct {
+		line   string
+		pos    int
+		expect string
+		ok     bool
+	}{
+		// from the outer paren, then from the inner one
+		{"x(a(b)c)y", 1, "xy", true},
+		{"x(a(b)c)y", 3, "x(ac)y", true},
+		// up to the next bracket
+		{"f (a, [b])", 0, "", true},
+		// a closing bracket cuts back to its pair
+		{"x(a(b)c)y", 7, "xy", true},
+		{"((a)", 0, "((a)", false},
+		{"(a", 0, "(a", false},
+		{"abc", 1, "abc", false},
+	}
+	for _, r := range ret {
+		b := &RuneBuffer{cfg: &Config{}, width: 80}
+		b.SetWithIdx(r.pos, []rune(r.line))
+		ok := b.DeleteToMatchingBracket()
+		if got := string(b.Runes()); got != r.expect || ok != r.ok {
+			t.Fatalf("%q at %d: unexpected %q, %v", r.line, r.pos, got, ok)
+		}
+	}
+}
+
+func TestSetConfigRuneWidthFunc(t *testing.T) {
+	rl, _ := newTestInstance(t, &Config{Prompt: "> "})
+	double := func(rune) int { return 2 }
+	rl.SetConfig(&Config{Prompt: "$ ", RuneWidthFunc: double, Stdin: rl.Config.Stdin})
+	// the new prompt is measured with the new RuneWidthFunc
+	if n := rl.Operation.buf.PromptLen(); n != 4 {
+		t.Fatalf("unexpected prompt width %d", n)
+	}
+}
@@ -129,6 +129,45 @@ func (Runes) ColorFilter(r []rune) []rune {
 	return newr
 }
 
+// StripANSI removes the escape sequences from r: the CSI ones (colors,
+// cursor moves...), the OSC ones ended by BEL or ST (e.g. the window title)
+// and the two rune escapes. A sequence cut at the end of r is dropped.
+func (Runes) StripANSI(r []rune) []rune {
+	newr := make([]rune, 0, len(r))
+	for pos := 0; pos < len(r); pos++ {
+		if r[pos] != '\033' {
+			newr = append(newr, r[pos])
+			continue
+		}
+		pos++
+		if pos >= len(r) {
+			break
+		}
+		switch r[pos] {
+		case '[':
+			// parameters and intermediates up to the final byte
+			for pos++; pos < len(r) && (r[pos] < 0x40 || r[pos] > 0x7e); pos++ {
+			}
+		case ']':
+			for pos++; pos < len(r); pos++ {
+				if r[pos] == '\a' {
+					break
+				}
+				if r[pos] == '\033' && pos+1 < len(r) && r[pos+1] == '\\' {
+					pos++
+					break
+				}
+			}
+		}
+	}
+	return newr
+}
+
+// StripANSIString is StripANSI for a string.
+func (rs Runes) StripANSIString(s string) string {
+	return string(rs.StripANSI([]rune(s)))
+}
+
 var zeroWidth = []*unicode.RangeTable{
 	unicode.Mn,
 	unicode.Me,
@@ -163,6 +202,50 @@ func (Runes) WidthAll(r []rune) (length int) {
 	return
 }
 
+// Truncate shortens r to at most width columns, ending it with an ellipsis
+// if anything was cut. Color sequences are kept and don't count in the width.
+func (rs Runes) Truncate(r []rune, width int) []rune {
+	return truncate(r, width, rs.Width)
+}
+
+// truncate is Runes.Truncate measuring the runes with runeWidth.
+func truncate(r []rune, width int, runeWidth func(rune) int) []rune {
+	rs := runes
+	fits := 0
+	for _, c := range rs.ColorFilter(r) {
+		fits += runeWidth(c)
+	}
+	if fits <= width {
+		return r
+	}
+	ret := make([]rune, 0, len(r))
+	colored := false
+	current := 0
+	for pos := 0; pos < len(r); pos++ {
+		if r[pos] == '\033' && pos+1 < len(r) && r[pos+1] == '[' {
+			if idx := rs.Index('m', r[pos+2:]); idx >= 0 {
+				ret = append(ret, r[pos:pos+idx+3]...)
+				pos += idx + 2
+				colored = true
+				continue
+			}
+		}
+		// leave a column for the ellipsis
+		current += runeWidth(r[pos])
+		if current > width-1 {
+			break
+		}
+		ret = append(ret, r[pos])
+	}
+	if width > 0 {
+		ret = append(ret, '…')
+	}
+	if colored {
+		ret = append(ret, []rune("\033[0m")...)
+	}
+	return ret
+}
+
 func (Runes) Backspace(r []rune) []byte {
 	return bytes.Repeat([]byte{'\b'}, runes.WidthAll(r))
 }
@@ -187,13 +270,32 @@ func (Runes) HasPrefix(r, prefix []rune) bool {
 	return runes.Equal(r[:len(prefix)], prefix)
 }
 
-func (Runes) Aggregate(candicate [][]rune) (same []rune, size int) {
+// PrefixLen returns the length of the longest common prefix of a and b.
+func (Runes) PrefixLen(a, b []rune) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (rs Runes) Aggregate(candicate [][]rune) (same []rune, size int) {
+	return rs.aggregate(candicate, false)
+}
+
+// AggregateFold is like Aggregate but compares the candidates case-insensitively,
+// the shared prefix is returned in the casing of the first candidate.
+func (rs Runes) AggregateFold(candicate [][]rune) (same []rune, size int) {
+	return rs.aggregate(candicate, true)
+}
+
+func (rs Runes) aggregate(candicate [][]rune, fold bool) (same []rune, size int) {
 	for i := 0; i < len(candicate[0]); i++ {
 		for j := 0; j < len(candicate)-1; j++ {
 			if i >= len(candicate[j]) || i >= len(candicate[j+1]) {
 				goto aggregate
 			}
-			if candicate[j][i] != candicate[j+1][i] {
+			if !rs.EqualRune(candicate[j][i], candicate[j+1][i], fold) {
 				goto aggregate
 			}
 		}
@@ -211,6 +313,14 @@ aggregate:
 	return
 }
 
+func (Runes) TrimSpaceRight(in []rune) []rune {
+	lastIndex := len(in)
+	for lastIndex > 0 && unicode.IsSpace(in[lastIndex-1]) {
+		lastIndex--
+	}
+	return in[:lastIndex]
+}
+
 func (Runes) TrimSpaceLeft(in []rune) []rune {
 	firstIndex := len(in)
 	for i, r := range in {
@@ -6,6 +6,7 @@ package runes
 import (
 	"bytes"
 	"unicode"
+	"unicode/utf8"
 )
 
 func Equal(a, b []rune) bool {
@@ -82,6 +83,45 @@ func ColorFilter(r []rune) []rune {
 	return newr
 }
 
+// StripANSI removes the escape sequences from r: the CSI ones (colors,
+// cursor moves...), the OSC ones ended by BEL or ST (e.g. the window title)
+// and the two rune escapes. A sequence cut at the end of r is dropped.
+func StripANSI(r []rune) []rune {
+	newr := make([]rune, 0, len(r))
+	for pos := 0; pos < len(r); pos++ {
+		if r[pos] != '\033' {
+			newr = append(newr, r[pos])
+			continue
+		}
+		pos++
+		if pos >= len(r) {
+			break
+		}
+		switch r[pos] {
+		case '[':
+			// parameters and intermediates up to the final byte
+			for pos++; pos < len(r) && (r[pos] < 0x40 || r[pos] > 0x7e); pos++ {
+			}
+		case ']':
+			for pos++; pos < len(r); pos++ {
+				if r[pos] == '\a' {
+					break
+				}
+				if r[pos] == '\033' && pos+1 < len(r) && r[pos+1] == '\\' {
+					pos++
+					break
+				}
+			}
+		}
+	}
+	return newr
+}
+
+// StripANSIString is StripANSI for a string.
+func StripANSIString(s string) string {
+	return string(StripANSI([]rune(s)))
+}
+
 var zeroWidth = []*unicode.RangeTable{
 	unicode.Mn,
 	unicode.Me,
@@ -113,6 +153,40 @@ func WidthAll(r []rune) (length int) {
 	return
 }
 
+// Truncate shortens r to at most width columns, ending it with an ellipsis
+// if anything was cut. Color sequences are kept and don't count in the width.
+func Truncate(r []rune, width int) []rune {
+	if WidthAll(ColorFilter(r)) <= width {
+		return r
+	}
+	ret := make([]rune, 0, len(r))
+	colored := false
+	current := 0
+	for pos := 0; pos < len(r); pos++ {
+		if r[pos] == '\033' && pos+1 < len(r) && r[pos+1] == '[' {
+			if idx := Index('m', r[pos+2:]); idx >= 0 {
+				ret = append(ret, r[pos:pos+idx+3]...)
+				pos += idx + 2
+				colored = true
+				continue
+			}
+		}
+		// leave a column for the ellipsis
+		current += Width(r[pos])
+		if current > width-1 {
+			break
+		}
+		ret = append(ret, r[pos])
+	}
+	if width > 0 {
+		ret = append(ret, '…')
+	}
+	if colored {
+		ret = append(ret, []rune("\033[0m")...)
+	}
+	return ret
+}
+
 func Backspace(r []rune) []byte {
 	return bytes.Repeat([]byte{'\b'}, WidthAll(r))
 }
@@ -131,12 +205,22 @@ func HasPrefix(r, prefix []rune) bool {
 }
 
 func Aggregate(candicate [][]rune) (same []rune, size int) {
+	return aggregate(candicate, false)
+}
+
+// AggregateFold is like Aggregate but compares the candidates case-insensitively,
+// the shared prefix is returned in the casing of the first candidate.
+func AggregateFold(candicate [][]rune) (same []rune, size int) {
+	return aggregate(candicate, true)
+}
+
+func aggregate(candicate [][]rune, fold bool) (same []rune, size int) {
 	for i := 0; i < len(candicate[0]); i++ {
 		for j := 0; j < len(candicate)-1; j++ {
 			if i >= len(candicate[j]) || i >= len(candicate[j+1]) {
 				goto aggregate
 			}
-			if candicate[j][i] != candicate[j+1][i] {
+			if !equalRune(candicate[j][i], candicate[j+1][i], fold) {
 				goto aggregate
 			}
 		}
@@ -153,3 +237,17 @@ aggregate:
 	}
 	return
 }
+
+// equalRune compares a and b, ignoring the ASCII case if fold is set.
+func equalRune(a, b rune, fold bool) bool {
+	if a == b {
+		return true
+	}
+	if !fold {
+		return false
+	}
+	if a > b {
+		a, b = b, a
+	}
+	return b < utf8.RuneSelf && 'A' <= a && a <= 'Z' && b == a+'a'-'A'
+}
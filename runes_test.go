@@ -66,3 +66,110 @@ func TestAggRunes(t *testing.T) {
 		}
 	}
 }
+
+func TestPrefixLen(t *testing.T) {
+	rs := []struct {
+		a, b   string
+		length int
+	}{
+		{"./foo/../bar", "./bar", 2},
+		{"abc", "abc", 3},
+		{"abc", "ab", 2},
+		{"", "abc", 0},
+		{"你好", "你们", 1},
+	}
+	for _, r := range rs {
+		if l := runes.PrefixLen([]rune(r.a), []rune(r.b)); l != r.length {
+			t.Fatal("result not expect", r.a, r.b, l)
+		}
+	}
+}
+
+func TestAggRunesFold(t *testing.T) {
+	rs := []struct {
+		r      [][]rune
+		e      [][]rune
+		same   string
+		length int
+	}{
+		{
+			[][]rune{[]rune("Git"), []rune("git-shell")},
+			[][]rune{[]rune(""), []rune("-shell")},
+			"Git", 3,
+		},
+		{
+			[][]rune{[]rune("git"), []rune("GIT-shell")},
+			[][]rune{[]rune(""), []rune("-shell")},
+			"git", 3,
+		},
+		{
+			[][]rune{[]rune("Git"), []rune("gif")},
+			[][]rune{[]rune("t"), []rune("f")},
+			"Gi", 2,
+		},
+		{
+			[][]rune{[]rune("go"), []rune("Git")},
+			[][]rune{[]rune("o"), []rune("it")},
+			"g", 1,
+		},
+	}
+	for _, r := range rs {
+		same, off := runes.AggregateFold(r.r)
+		if off != r.length || string(same) != r.same {
+			t.Fatal("result not expect", string(same), off)
+		}
+		if !reflect.DeepEqual(r.r, r.e) {
+			t.Fatal("result not expect", r.r)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	rs := []struct {
+		r      string
+		width  int
+		expect string
+	}{
+		{"hello", 5, "hello"},
+		{"hello world", 8, "hello w…"},
+		{"你好世界", 5, "你好…"},
+		{"\033[31mhello\033[0m world", 6, "\033[31mhello\033[0m…\033[0m"},
+		{"\033[31mhello world", 4, "\033[31mhel…\033[0m"},
+	}
+	for _, r := range rs {
+		if got := string(runes.Truncate([]rune(r.r), r.width)); got != r.expect {
+			t.Fatalf("%q: unexpected %q", r.r, got)
+		}
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	for in, expect := range map[string]string{
+		"hello":                                    "hello",
+		"\033[31mred\033[0m":                       "red",
+		"\033[1;38;5;208mbold\033[22m 你好":          "bold 你好",
+		"a\033[2Kb\033[3Cc\033[?25ld":              "abcd",
+		"\033]0;title\007prompt":                   "prompt",
+		"\033]8;;http://x\033\\link\033]8;;\033\\": "link",
+		"\033=keypad\033>":                         "keypad",
+		"cut\033[3":                                "cut",
+		"end\033":                                  "end",
+	} {
+		if got := runes.StripANSIString(in); got != expect {
+			t.Fatalf("%q: expected %q, got %q", in, expect, got)
+		}
+	}
+}
+
+func TestTrimSpaceRight(t *testing.T) {
+	for in, expect := range map[string]string{
+		"ls  ":    "ls",
+		"ls \t\n": "ls",
+		" ls":     " ls",
+		"   ":     "",
+	} {
+		if got := string(runes.TrimSpaceRight([]rune(in))); got != expect {
+			t.Fatalf("%q: expected %q, got %q", in, expect, got)
+		}
+	}
+}
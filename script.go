@@ -0,0 +1,49 @@
+package readline
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// RunScript feeds keystrokes to an instance made from cfg as if they were
+// typed in a terminal, e.g. for testing the completers and the key bindings
+// of an application end-to-end. It returns the accepted lines and the bytes
+// written to the terminal once all the keystrokes are consumed.
+//
+// Stdin, Stdout and the terminal functions of cfg are replaced, the width
+// is 80 unless FuncGetWidth is set.
+func RunScript(cfg *Config, keystrokes []byte) (lines []string, output []byte, err error) {
+	out := bytes.NewBuffer(nil)
+	c := cfg.Clone()
+	c.Stdin = ioutil.NopCloser(bytes.NewReader(keystrokes))
+	c.Stdout = out
+	c.Stderr = out
+	c.FuncIsTerminal = func() bool { return true }
+	c.FuncMakeRaw = func() error { return nil }
+	c.FuncExitRaw = func() error { return nil }
+	c.FuncOnWidthChanged = func(func()) {}
+	if c.FuncGetWidth == nil {
+		c.FuncGetWidth = func() int { return 80 }
+	}
+
+	rl, err := NewEx(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rl.Close()
+	for {
+		line, err := rl.Readline()
+		if err == io.EOF {
+			break
+		}
+		if err == ErrInterrupt {
+			continue
+		}
+		if err != nil {
+			return lines, out.Bytes(), err
+		}
+		lines = append(lines, line)
+	}
+	return lines, out.Bytes(), nil
+}
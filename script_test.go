@@ -0,0 +1,24 @@
+package readline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunScript(t *testing.T) {
+	cfg := &Config{
+		Prompt:       "> ",
+		AutoComplete: NewPrefixCompleter(PcItem("hello"), PcItem("world")),
+	}
+	lines, output, err := RunScript(cfg, []byte("wo\t\rbye\x03hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, "|") != "world |hi" {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+	if !bytes.Contains(output, []byte("> world")) {
+		t.Fatalf("unexpected output %q", output)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"container/list"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 )
 
 const (
@@ -18,18 +20,22 @@ const (
 )
 
 type opSearch struct {
-	inMode    bool
-	state     int
-	dir       int
-	source    *list.Element
-	w         io.Writer
-	buf       *RuneBuffer
-	data      []rune
-	history   *opHistory
-	cfg       *Config
-	markStart int
-	markEnd   int
-	width     int
+	inMode  bool
+	state   int
+	dir     int
+	source  *list.Element
+	w       io.Writer
+	buf     *RuneBuffer
+	data    []rune
+	history *opHistory
+	cfg     *Config
+	// the ranges of the match underlined
+	marks [][2]int
+	width int
+
+	// used by the backward search when FuncHistoryIterator is set
+	iter      HistoryIterator
+	iterMatch []rune
 }
 
 func newOpSearch(w io.Writer, buf *RuneBuffer, history *opHistory, cfg *Config, width int) *opSearch {
@@ -53,6 +59,8 @@ func (o *opSearch) IsSearchMode() bool {
 func (o *opSearch) SearchBackspace() {
 	if len(o.data) > 0 {
 		o.data = o.data[:len(o.data)-1]
+		// a shorter keyword may match newer entries
+		o.iter = nil
 		o.search(true)
 	}
 }
@@ -70,6 +78,12 @@ func (o *opSearch) search(isChange bool) bool {
 		o.SearchRefresh(-1)
 		return true
 	}
+	if o.dir == S_DIR_BCK && o.cfg.FuncHistoryIterator != nil {
+		return o.searchIterator(isChange)
+	}
+	if o.cfg.HistoryMatcher != nil {
+		return o.searchMatcher(isChange)
+	}
 	idx, elem := o.findHistoryBy(isChange)
 	if elem == nil {
 		o.SearchRefresh(-2)
@@ -77,7 +91,7 @@ func (o *opSearch) search(isChange bool) bool {
 	}
 	o.history.current = elem
 
-	item := o.history.showItem(o.history.current.Value)
+	item := o.history.showItem(o.history.current)
 	start, end := 0, 0
 	if o.dir == S_DIR_BCK {
 		start, end = idx, idx+len(o.data)
@@ -86,7 +100,119 @@ func (o *opSearch) search(isChange bool) bool {
 		idx += len(o.data)
 	}
 	o.buf.SetWithIdx(idx, item)
-	o.markStart, o.markEnd = start, end
+	o.marks = [][2]int{{start, end}}
+	o.SearchRefresh(idx)
+	return true
+}
+
+// searchMatcher looks for the entries matched by HistoryMatcher from the
+// current one, which is skipped unless the keyword changed.
+func (o *opSearch) searchMatcher(isChange bool) bool {
+	for elem := o.history.current; elem != nil; {
+		if elem != o.history.current || isChange {
+			item := o.history.showItem(elem)
+			if idx, marks := o.matchItem(item); idx >= 0 {
+				o.history.current = elem
+				o.buf.SetWithIdx(idx, item)
+				o.marks = marks
+				o.SearchRefresh(idx)
+				return true
+			}
+		}
+		if o.dir == S_DIR_BCK {
+			elem = elem.Prev()
+		} else {
+			elem = elem.Next()
+		}
+	}
+	o.SearchRefresh(-2)
+	return false
+}
+
+// matchItem returns where the cursor goes in item if it matches the
+// keyword (-1 otherwise) and the ranges to underline. The cursor is at
+// the start of the match, or at its end in a forward search with a
+// HistoryMatcher.
+func (o *opSearch) matchItem(item []rune) (int, [][2]int) {
+	if o.cfg.HistoryMatcher == nil {
+		idx := runes.IndexAllBckEx(item, o.data, o.cfg.HistorySearchFold)
+		if idx < 0 {
+			return -1, nil
+		}
+		return idx, [][2]int{{idx, idx + len(o.data)}}
+	}
+	ok, ranges := o.cfg.HistoryMatcher(string(item), string(o.data))
+	if !ok {
+		return -1, nil
+	}
+	marks := cleanRanges(ranges, len(item))
+	switch {
+	case o.dir == S_DIR_FWD && len(marks) > 0:
+		return marks[len(marks)-1][1], marks
+	case o.dir == S_DIR_FWD:
+		return len(item), marks
+	case len(marks) > 0:
+		return marks[0][0], marks
+	}
+	return 0, marks
+}
+
+// cleanRanges returns the non-empty ranges within [0, n) sorted, the
+// overlapping ones merged.
+func cleanRanges(ranges [][2]int, n int) [][2]int {
+	var ret [][2]int
+	for _, r := range ranges {
+		if r[0] < 0 {
+			r[0] = 0
+		}
+		if r[1] > n {
+			r[1] = n
+		}
+		if r[0] < r[1] {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i][0] < ret[j][0] })
+	merged := ret[:0]
+	for _, r := range ret {
+		if last := len(merged) - 1; last >= 0 && r[0] <= merged[last][1] {
+			if r[1] > merged[last][1] {
+				merged[last][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// searchIterator searches backward in the entries of FuncHistoryIterator.
+func (o *opSearch) searchIterator(isChange bool) bool {
+	if o.iter == nil {
+		o.iter = o.cfg.FuncHistoryIterator()
+		o.iterMatch = nil
+	}
+
+	item := o.iterMatch
+	idx := -1
+	var marks [][2]int
+	if isChange && item != nil {
+		// the current match may still match the longer keyword
+		idx, marks = o.matchItem(item)
+	}
+	for idx < 0 {
+		line, ok := o.iter.Prev()
+		if !ok {
+			o.SearchRefresh(-2)
+			return false
+		}
+		item = []rune(line)
+		idx, marks = o.matchItem(item)
+	}
+
+	o.iterMatch = item
+	o.buf.SetWithIdx(idx, runes.Copy(item))
+	o.marks = marks
 	o.SearchRefresh(idx)
 	return true
 }
@@ -97,16 +223,17 @@ func (o *opSearch) SearchChar(r rune) {
 }
 
 func (o *opSearch) SearchMode(dir int) bool {
-	if o.width == 0 {
+	if o.width == 0 || o.cfg.usePlainOutput() {
 		return false
 	}
 	alreadyInMode := o.inMode
 	o.inMode = true
 	o.dir = dir
-	o.source = o.history.current
 	if alreadyInMode {
+		// keeps showing the last match if there are no more
 		o.search(false)
 	} else {
+		o.source = o.history.current
 		o.SearchRefresh(-1)
 	}
 	return true
@@ -115,13 +242,39 @@ func (o *opSearch) SearchMode(dir int) bool {
 func (o *opSearch) ExitSearchMode(revert bool) {
 	if revert {
 		o.history.current = o.source
-		o.buf.Set(o.history.showItem(o.history.current.Value))
+		o.buf.Set(o.history.showItem(o.history.current))
 	}
-	o.markStart, o.markEnd = 0, 0
+	o.marks = nil
 	o.state = S_STATE_FOUND
 	o.inMode = false
 	o.source = nil
 	o.data = nil
+	o.iter = nil
+	o.iterMatch = nil
+}
+
+// searchPrompt returns the prompt showing the keyword, followed by a fake
+// cursor (_).
+func (o *opSearch) searchPrompt() string {
+	keyword := string(o.data) + "\033[4m \033[0m"
+	prompt := o.cfg.SearchPrompt
+	if prompt == "" {
+		prompt = "bck-i-search: %s"
+		if o.dir == S_DIR_FWD {
+			prompt = "fwd-i-search: %s"
+		}
+	}
+	if o.state == S_STATE_FAILING {
+		if o.cfg.SearchFailingPrompt != "" {
+			prompt = o.cfg.SearchFailingPrompt
+		} else {
+			prompt = "failing " + prompt
+		}
+	}
+	if !strings.Contains(prompt, "%s") {
+		return prompt + keyword
+	}
+	return strings.Replace(prompt, "%s", keyword, 1)
 }
 
 func (o *opSearch) SearchRefresh(x int) {
@@ -137,25 +290,15 @@ func (o *opSearch) SearchRefresh(x int) {
 	x += o.buf.PromptLen()
 	x = x % o.width
 
-	if o.markStart > 0 {
-		o.buf.SetStyle(o.markStart, o.markEnd, "4")
+	if len(o.marks) > 0 {
+		o.buf.SetStyles(o.marks, "4")
 	}
 
 	lineCnt := o.buf.CursorLineCount()
 	buf := bytes.NewBuffer(nil)
 	buf.Write(bytes.Repeat([]byte("\n"), lineCnt))
 	buf.WriteString("\033[J")
-	if o.state == S_STATE_FAILING {
-		buf.WriteString("failing ")
-	}
-	if o.dir == S_DIR_BCK {
-		buf.WriteString("bck")
-	} else if o.dir == S_DIR_FWD {
-		buf.WriteString("fwd")
-	}
-	buf.WriteString("-i-search: ")
-	buf.WriteString(string(o.data))         // keyword
-	buf.WriteString("\033[4m \033[0m")      // _
+	buf.WriteString(o.searchPrompt())
 	fmt.Fprintf(buf, "\r\033[%dA", lineCnt) // move prev
 	if x > 0 {
 		fmt.Fprintf(buf, "\033[%dC", x) // move forward
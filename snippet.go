@@ -0,0 +1,132 @@
+package readline
+
+import (
+	"sort"
+)
+
+// snippetTabstop is where a placeholder of a snippet was written in the
+// line, from start to end (its default text).
+type snippetTabstop struct {
+	num        int
+	start, end int
+}
+
+// parseSnippet replaces the placeholders of text, ${1:default}, ${1} or $1,
+// by their default text and returns the tabstops in the order they're
+// visited: 1, 2... and 0 last, which is the end of text if it's missing.
+// Only the first placeholder of a number is kept.
+func parseSnippet(text []rune) ([]rune, []snippetTabstop) {
+	var ret []rune
+	var stops []snippetTabstop
+	seen := map[int]bool{}
+	for i := 0; i < len(text); i++ {
+		num, def, end, ok := readPlaceholder(text, i)
+		if !ok {
+			ret = append(ret, text[i])
+			continue
+		}
+		if !seen[num] {
+			seen[num] = true
+			stops = append(stops, snippetTabstop{num, len(ret), len(ret) + len(def)})
+		}
+		ret = append(ret, def...)
+		i = end - 1
+	}
+	if !seen[0] {
+		stops = append(stops, snippetTabstop{0, len(ret), len(ret)})
+	}
+	sort.SliceStable(stops, func(i, j int) bool {
+		return stops[j].num == 0 || stops[i].num != 0 && stops[i].num < stops[j].num
+	})
+	return ret, stops
+}
+
+// readPlaceholder reads the placeholder at text[i:], if any, and returns
+// its number, its default text and the index following it.
+func readPlaceholder(text []rune, i int) (num int, def []rune, end int, ok bool) {
+	if text[i] != '$' || i+1 >= len(text) {
+		return
+	}
+	i++
+	braced := text[i] == '{'
+	if braced {
+		i++
+	}
+	start := i
+	for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+		num = num*10 + int(text[i]-'0')
+		i++
+	}
+	if i == start {
+		return
+	}
+	if !braced {
+		return num, nil, i, true
+	}
+	if i < len(text) && text[i] == ':' {
+		i++
+		defStart := i
+		for i < len(text) && text[i] != '}' {
+			i++
+		}
+		def = text[defStart:i]
+	}
+	if i >= len(text) || text[i] != '}' {
+		return 0, nil, 0, false
+	}
+	return num, def, i + 1, true
+}
+
+// opSnippet moves the cursor through the tabstops of the snippet written
+// last with CompleteKey.
+type opSnippet struct {
+	o       *Operation
+	stops   []snippetTabstop
+	current int
+	// the length of the line when the cursor was moved to the current
+	// tabstop, what's typed since then shifts the next ones
+	lineLen int
+}
+
+func newOpSnippet(o *Operation) *opSnippet {
+	return &opSnippet{o: o}
+}
+
+func (o *opSnippet) IsInSnippetMode() bool {
+	return len(o.stops) > 0
+}
+
+// EnterSnippetMode moves the cursor to the first tabstop, their indexes
+// are shifted by base, where the snippet starts in the line.
+func (o *opSnippet) EnterSnippetMode(stops []snippetTabstop, base int) {
+	o.stops = make([]snippetTabstop, 0, len(stops))
+	for _, s := range stops {
+		o.stops = append(o.stops, snippetTabstop{s.num, s.start + base, s.end + base})
+	}
+	o.current = -1
+	o.NextTabstop()
+}
+
+func (o *opSnippet) ExitSnippetMode() {
+	o.stops = nil
+}
+
+// NextTabstop moves the cursor to the end of the next tabstop, the snippet
+// mode ends at the last one.
+func (o *opSnippet) NextTabstop() {
+	buf := o.o.buf
+	if o.current >= 0 {
+		delta := buf.Len() - o.lineLen
+		o.stops[o.current].end += delta
+		for i := o.current + 1; i < len(o.stops); i++ {
+			o.stops[i].start += delta
+			o.stops[i].end += delta
+		}
+	}
+	o.current++
+	o.lineLen = buf.Len()
+	buf.MoveCursor(o.stops[o.current].end - buf.Pos())
+	if o.current == len(o.stops)-1 {
+		o.ExitSnippetMode()
+	}
+}
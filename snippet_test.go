@@ -0,0 +1,63 @@
+package readline
+
+import (
+	"testing"
+)
+
+func TestParseSnippet(t *testing.T) {
+	ret := []struct {
+		snippet string
+		expect  string
+		stops   []snippetTabstop
+	}{
+		{"for (${1:i}=0; ${2:n}) { $0 }", "for (i=0; n) {  }",
+			[]snippetTabstop{{1, 5, 6}, {2, 10, 11}, {0, 15, 15}}},
+		// $0 is implicitly at the end, the numbers are sorted
+		{"f(${2}, ${1:x})", "f(, x)", []snippetTabstop{{1, 4, 5}, {2, 2, 2}, {0, 6, 6}}},
+		// not placeholders
+		{"$ a${x} ${1", "$ a${x} ${1", []snippetTabstop{{0, 11, 11}}},
+	}
+	for _, r := range ret {
+		text, stops := parseSnippet([]rune(r.snippet))
+		if string(text) != r.expect {
+			t.Fatalf("%q: unexpected text %q", r.snippet, text)
+		}
+		if len(stops) != len(r.stops) {
+			t.Fatalf("%q: unexpected tabstops %v", r.snippet, stops)
+		}
+		for i := range stops {
+			if stops[i] != r.stops[i] {
+				t.Fatalf("%q: unexpected tabstops %v", r.snippet, stops)
+			}
+		}
+	}
+}
+
+type snippetCompleter struct{}
+
+func (snippetCompleter) Do([]rune, int) ([][]rune, int) {
+	return nil, 0
+}
+
+func (snippetCompleter) Complete(line []rune, pos int) []Candidate {
+	if string(line[:pos]) != "fo" {
+		return nil
+	}
+	return []Candidate{{
+		NewLine:      []rune("for (${1:i}=0; ${2:n}) { $0 }"),
+		ReplaceStart: 0,
+		ReplaceEnd:   pos,
+		Snippet:      true,
+	}}
+}
+
+func TestSnippetTabstops(t *testing.T) {
+	rl, w := newTestInstance(t, &Config{AutoComplete: snippetCompleter{}})
+	// replace "i" and "n", then type at $0
+	go w.Write([]byte("fo\t\x7fj\t\x7fcount\tx\r"))
+	expectLine(t, rl, "for (j=0; count) { x }")
+
+	// Ctrl-G leaves the snippet, Tab doesn't move to "n" then
+	go w.Write([]byte("fo\t\x07\x05\tx\r"))
+	expectLine(t, rl, "for (i=0; n) {  }x")
+}
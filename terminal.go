@@ -7,8 +7,14 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+// pasteBurstSize is the number of bytes a single read must return to be
+// taken for a paste: even the longest key sequences are shorter.
+const pasteBurstSize = 16
+
 type Terminal struct {
 	m         sync.Mutex
 	cfg       *Config
@@ -21,6 +27,14 @@ type Terminal struct {
 	sleeping  int32
 
 	sizeChan chan string
+	// keyRaw carries the raw bytes of each key sent on outchan, ahead of
+	// it, they're kept in lastKey once the key is received
+	keyRaw    chan []byte
+	lastKeyMu sync.Mutex
+	lastKey   []byte
+	// the row of the cursor reported last, where the mouse clicks are
+	// told from
+	cursorRow int32
 }
 
 func NewTerminal(cfg *Config) (*Terminal, error) {
@@ -33,6 +47,7 @@ func NewTerminal(cfg *Config) (*Terminal, error) {
 		outchan:  make(chan rune),
 		stopChan: make(chan struct{}, 1),
 		sizeChan: make(chan string, 1),
+		keyRaw:   make(chan []byte, 1),
 	}
 
 	go t.ioloop()
@@ -54,11 +69,34 @@ func (t *Terminal) SleepToResume() {
 }
 
 func (t *Terminal) EnterRawMode() (err error) {
-	return t.cfg.FuncMakeRaw()
+	if t.cfg.usePlainOutput() {
+		// let the terminal echo the keys
+		return nil
+	}
+	if err = t.cfg.FuncMakeRaw(); err != nil {
+		return err
+	}
+	if t.cfg.EnableMouse {
+		// report the clicks, in the SGR encoding if supported
+		t.Write([]byte("\033[?1000h\033[?1006h"))
+	}
+	if t.cfg.OnEnterRawMode != nil {
+		t.cfg.OnEnterRawMode()
+	}
+	return nil
 }
 
 func (t *Terminal) ExitRawMode() (err error) {
-	return t.cfg.FuncExitRaw()
+	if t.cfg.usePlainOutput() {
+		return nil
+	}
+	if t.cfg.EnableMouse {
+		t.Write([]byte("\033[?1006l\033[?1000l"))
+	}
+	if err = t.cfg.FuncExitRaw(); err == nil && t.cfg.OnExitRawMode != nil {
+		t.cfg.OnExitRawMode()
+	}
+	return err
 }
 
 func (t *Terminal) Write(b []byte) (int, error) {
@@ -76,6 +114,13 @@ type termSize struct {
 	top  int
 }
 
+// reportedCursorRow returns the 1-based row of the cursor as reported last
+// by the terminal, 0 if unknown. The candidate grid asks for it when
+// EnableMouse is set.
+func (t *Terminal) reportedCursorRow() int {
+	return int(atomic.LoadInt32(&t.cursorRow))
+}
+
 func (t *Terminal) GetOffset(f func(offset string)) {
 	go func() {
 		f(<-t.sizeChan)
@@ -101,9 +146,27 @@ func (t *Terminal) ReadRune() rune {
 	if !ok {
 		return rune(0)
 	}
+	t.receivedKey()
 	return ch
 }
 
+// receivedKey is called once a key is taken from outchan, its raw bytes
+// become the LastKeyBytes.
+func (t *Terminal) receivedKey() {
+	raw := <-t.keyRaw
+	t.lastKeyMu.Lock()
+	t.lastKey = raw
+	t.lastKeyMu.Unlock()
+}
+
+// LastKeyBytes returns the raw bytes read from the terminal for the last
+// key received from it.
+func (t *Terminal) LastKeyBytes() []byte {
+	t.lastKeyMu.Lock()
+	defer t.lastKeyMu.Unlock()
+	return append([]byte(nil), t.lastKey...)
+}
+
 func (t *Terminal) IsReading() bool {
 	return atomic.LoadInt32(&t.isReading) == 1
 }
@@ -115,6 +178,73 @@ func (t *Terminal) KickRead() {
 	}
 }
 
+// rawKeyReader records the bytes consumed since the last reset,
+// so that the raw sequence behind a decoded key is known.
+type rawKeyReader struct {
+	*bufio.Reader
+	raw  []byte
+	size int
+}
+
+func (r *rawKeyReader) ReadRune() (ch rune, size int, err error) {
+	ch, size, err = r.Reader.ReadRune()
+	if err == nil {
+		var b [utf8.UTFMax]byte
+		r.size = utf8.EncodeRune(b[:], ch)
+		r.raw = append(r.raw, b[:r.size]...)
+	}
+	return
+}
+
+func (r *rawKeyReader) UnreadRune() error {
+	if err := r.Reader.UnreadRune(); err != nil {
+		return err
+	}
+	r.raw = r.raw[:len(r.raw)-r.size]
+	r.size = 0
+	return nil
+}
+
+func (r *rawKeyReader) resetRaw() {
+	r.raw = r.raw[:0]
+	r.size = 0
+}
+
+// sendKey passes the key decoded from raw to the reader.
+func (t *Terminal) sendKey(r rune, raw []byte) {
+	t.keyRaw <- append([]byte(nil), raw...)
+	t.outchan <- r
+}
+
+func (t *Terminal) logKey(r rune, raw []byte) {
+	if t.cfg.DebugKeyLog == nil {
+		return
+	}
+	fmt.Fprintf(t.cfg.DebugKeyLog, "key=%s raw=%q\n", keyName(r), raw)
+}
+
+// waitEscapeFollowUp waits for more input to arrive after an ESC, in which
+// case the ESC is the prefix of a sequence (e.g. Alt+key) and nil is returned.
+// Otherwise, it returns a channel which is closed once the input arrives,
+// the reader must not be used until then.
+func (t *Terminal) waitEscapeFollowUp(buf *rawKeyReader) chan struct{} {
+	timeout := t.cfg.EscapeTimeout
+	if timeout < 0 || buf.Buffered() > 0 {
+		return nil
+	}
+	peeked := make(chan struct{})
+	go func() {
+		buf.Peek(1)
+		close(peeked)
+	}()
+	select {
+	case <-peeked:
+		return nil
+	case <-time.After(timeout):
+		return peeked
+	}
+}
+
 func (t *Terminal) ioloop() {
 	t.wg.Add(1)
 	defer func() {
@@ -126,10 +256,14 @@ func (t *Terminal) ioloop() {
 		isEscape       bool
 		isEscapeEx     bool
 		isEscapeSS3    bool
+		isQuoted       bool
 		expectNextChar bool
+		peeking        chan struct{}
+		// the bytes left of the paste being read
+		pasteLeft int
 	)
 
-	buf := bufio.NewReader(t.getStdin())
+	buf := &rawKeyReader{Reader: bufio.NewReader(t.getStdin())}
 	for {
 		if !expectNextChar {
 			atomic.StoreInt32(&t.isReading, 0)
@@ -141,7 +275,25 @@ func (t *Terminal) ioloop() {
 			}
 		}
 		expectNextChar = false
-		r, _, err := buf.ReadRune()
+		if peeking != nil {
+			// wait for the input following a lone ESC
+			<-peeking
+			peeking = nil
+		}
+		if isEscape {
+			if peeking = t.waitEscapeFollowUp(buf); peeking != nil {
+				// nothing followed the ESC in time, it's a key on its own
+				isEscape = false
+				expectNextChar = true
+				t.logKey(CharEsc, buf.raw)
+				t.sendKey(CharEsc, buf.raw)
+				continue
+			}
+		}
+		if !isEscape && !isEscapeEx && !isEscapeSS3 {
+			buf.resetRaw()
+		}
+		r, size, err := buf.ReadRune()
 		if err != nil {
 			if strings.Contains(err.Error(), "interrupted system call") {
 				expectNextChar = true
@@ -150,6 +302,32 @@ func (t *Terminal) ioloop() {
 			break
 		}
 
+		pasting := pasteLeft > 0
+		if pasting {
+			pasteLeft -= size
+		} else if n := buf.Buffered(); n >= pasteBurstSize {
+			pasting = true
+			pasteLeft = n
+		}
+		if pasting && t.cfg.SanitizePaste && !isEscape && !isEscapeEx && !isEscapeSS3 && !isQuoted {
+			if r == CharTab {
+				// insert it rather than completing
+				r = quotedKey(r)
+			} else if isControlRune(r) && r != CharEnter && r != CharCtrlJ {
+				expectNextChar = true
+				continue
+			}
+		}
+
+		if isQuoted {
+			// the key after Ctrl-V is inserted as it is
+			isQuoted = false
+			expectNextChar = true
+			t.logKey(r, buf.raw)
+			t.sendKey(quotedKey(r), buf.raw)
+			continue
+		}
+
 		if isEscape {
 			isEscape = false
 			if r == CharEscapeEx {
@@ -166,11 +344,14 @@ func (t *Terminal) ioloop() {
 			r = escapeKey(r, buf)
 		} else if isEscapeEx {
 			isEscapeEx = false
-			if key := readEscKey(r, buf); key != nil {
+			if t.cfg.EnableMouse && (r == '<' || r == 'M') {
+				r = readMouseKey(r, buf)
+			} else if key := readEscKey(r, buf); key != nil {
 				r = escapeExKey(key)
 				// offset
 				if key.typ == 'R' {
-					if _, _, ok := key.Get2(); ok {
+					if row, _, ok := key.Get2(); ok {
+						atomic.StoreInt32(&t.cursorRow, int32(row))
 						select {
 						case t.sizeChan <- key.attr:
 						default:
@@ -196,24 +377,35 @@ func (t *Terminal) ioloop() {
 		}
 
 		expectNextChar = true
+		if r == 0 {
+			r = CharCtrlSpace
+		}
 		switch r {
 		case CharEsc:
 			if t.cfg.VimMode {
-				t.outchan <- r
+				t.logKey(r, buf.raw)
+				t.sendKey(r, buf.raw)
 				break
 			}
 			isEscape = true
+		case CharCtrlV:
+			t.logKey(r, buf.raw)
+			isQuoted = true
 		case CharInterrupt, CharEnter, CharCtrlJ, CharDelete:
 			expectNextChar = false
 			fallthrough
 		default:
-			t.outchan <- r
+			t.logKey(r, buf.raw)
+			t.sendKey(r, buf.raw)
 		}
 	}
 
 }
 
 func (t *Terminal) Bell() {
+	if t.cfg.usePlainOutput() {
+		return
+	}
 	fmt.Fprintf(t, "%c", CharBell)
 }
 
@@ -0,0 +1,53 @@
+package readline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebugKeyLog(t *testing.T) {
+	log := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{DebugKeyLog: log})
+	go w.Write([]byte("a\033[Hb\r"))
+
+	expectLine(t, rl, "ba")
+	expected := []string{
+		`key='a' raw="a"`,
+		`key=LineStart raw="\x1b[H"`,
+		`key='b' raw="b"`,
+		`key=Enter raw="\r"`,
+	}
+	if got := strings.TrimSpace(log.String()); got != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected log:\n%s", got)
+	}
+}
+
+func TestEscapeTimeout(t *testing.T) {
+	log := bytes.NewBuffer(nil)
+	rl, w := newTestInstance(t, &Config{
+		DebugKeyLog:   log,
+		EscapeTimeout: 20 * time.Millisecond,
+	})
+	go func() {
+		w.Write([]byte("ab\033b"))
+		w.Write([]byte("\033"))
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("c\r"))
+	}()
+
+	// Meta-b moves to the start, the lone ESC does nothing
+	expectLine(t, rl, "cab")
+	expected := []string{
+		`key='a' raw="a"`,
+		`key='b' raw="b"`,
+		`key=MetaBackward raw="\x1bb"`,
+		`key=Esc raw="\x1b"`,
+		`key='c' raw="c"`,
+		`key=Enter raw="\r"`,
+	}
+	if got := strings.TrimSpace(log.String()); got != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected log:\n%s", got)
+	}
+}
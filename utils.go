@@ -1,10 +1,10 @@
 package readline
 
 import (
-	"bufio"
 	"bytes"
 	"container/list"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"strconv"
@@ -39,7 +39,9 @@ const (
 	CharFwdSearch = 19
 	CharTranspose = 20
 	CharCtrlU     = 21
+	CharCtrlV     = 22
 	CharCtrlW     = 23
+	CharCtrlX     = 24
 	CharCtrlY     = 25
 	CharCtrlZ     = 26
 	CharEsc       = 27
@@ -54,8 +56,67 @@ const (
 	MetaDelete
 	MetaBackspace
 	MetaTranspose
+
+	// NUL is used for signaling EOF, so the terminal reports
+	// Ctrl-Space (which sends NUL) as this key instead
+	CharCtrlSpace
+	// the Delete key (`Esc[3~`), unlike Ctrl-D it never means EOF
+	CharForwardDelete
+
+	// never read from the terminal, a key may be bound to them in a KeyMap:
+	// they go to the previous or next history entry starting with the line
+	// before the cursor
+	CharHistorySearchBackward
+	CharHistorySearchForward
 )
 
+// metaFlag marks a key pressed along with Meta, see MetaKey.
+const metaFlag rune = 1 << 30
+
+// MetaKey returns the key reported when r is pressed along with Meta
+// (i.e. `Esc`+r or `Alt`+r), for the keys which have no Meta* constant.
+func MetaKey(r rune) rune {
+	return r | metaFlag
+}
+
+// IsMetaKey reports whether the key was pressed along with Meta,
+// and returns the key without the Meta modifier.
+func IsMetaKey(key rune) (rune, bool) {
+	if key > 0 && key&metaFlag != 0 {
+		return key &^ metaFlag, true
+	}
+	return key, false
+}
+
+// quotedFlag marks a key read after Ctrl-V, which is inserted as it is.
+const quotedFlag rune = 1 << 29
+
+func quotedKey(r rune) rune {
+	return r | quotedFlag
+}
+
+func isQuotedKey(key rune) (rune, bool) {
+	if key > 0 && key&quotedFlag != 0 {
+		return key &^ quotedFlag, true
+	}
+	return key, false
+}
+
+// mouseFlag marks a click of the left mouse button (see Config.EnableMouse),
+// the key holds the 1-based column and row of the screen cell clicked.
+const mouseFlag rune = 1 << 28
+
+func mouseClickKey(col, row int) rune {
+	return mouseFlag | rune(row&0xfff)<<12 | rune(col&0xfff)
+}
+
+func isMouseClick(key rune) (col, row int, ok bool) {
+	if key > 0 && key&mouseFlag != 0 && key&(metaFlag|quotedFlag) == 0 {
+		return int(key & 0xfff), int(key >> 12 & 0xfff), true
+	}
+	return 0, 0, false
+}
+
 // WaitForResume need to call before current process got suspend.
 // It will run a ticker until a long duration is occurs,
 // which means this process is resumed.
@@ -99,6 +160,12 @@ func IsPrintable(key rune) bool {
 	return key >= 32 && !isInSurrogateArea
 }
 
+// isControlRune reports whether r is an ASCII control character, i.e.
+// a key such as Ctrl-A or Backspace rather than text.
+func isControlRune(r rune) bool {
+	return r >= 0 && r < 32 || r == CharBackspace
+}
+
 // translate Esc[X
 func escapeExKey(key *escapeKeyPair) rune {
 	var r rune
@@ -117,7 +184,7 @@ func escapeExKey(key *escapeKeyPair) rune {
 		r = CharLineEnd
 	case '~':
 		if key.attr == "3" {
-			r = CharDelete
+			r = CharForwardDelete
 		}
 	default:
 	}
@@ -166,7 +233,7 @@ func (e *escapeKeyPair) Get2() (int, int, bool) {
 	return s1, s2, true
 }
 
-func readEscKey(r rune, reader *bufio.Reader) *escapeKeyPair {
+func readEscKey(r rune, reader io.RuneScanner) *escapeKeyPair {
 	p := escapeKeyPair{}
 	buf := bytes.NewBuffer(nil)
 	for {
@@ -183,8 +250,39 @@ func readEscKey(r rune, reader *bufio.Reader) *escapeKeyPair {
 	return &p
 }
 
+// readMouseKey decodes the mouse report following `Esc[<` (r is '<', the
+// SGR encoding) or `Esc[M` (r is 'M', the X10 one). It returns 0 unless
+// it's a press of the left button.
+func readMouseKey(r rune, reader io.RuneScanner) rune {
+	var b, col, row int
+	if r == 'M' {
+		var codes [3]int
+		for i := range codes {
+			r, _, _ = reader.ReadRune()
+			codes[i] = int(r) - 32
+		}
+		b, col, row = codes[0], codes[1], codes[2]
+	} else {
+		r, _, _ = reader.ReadRune()
+		key := readEscKey(r, reader)
+		sp := strings.Split(key.attr, ";")
+		if key.typ != 'M' || len(sp) != 3 {
+			// a release
+			return 0
+		}
+		b, _ = strconv.Atoi(sp[0])
+		col, _ = strconv.Atoi(sp[1])
+		row, _ = strconv.Atoi(sp[2])
+	}
+	// the left button without modifiers, not moving nor the wheel
+	if b != 0 || col <= 0 || row <= 0 {
+		return 0
+	}
+	return mouseClickKey(col, row)
+}
+
 // translate EscX to Meta+X
-func escapeKey(r rune, reader *bufio.Reader) rune {
+func escapeKey(r rune, reader io.RuneScanner) rune {
 	switch r {
 	case 'b':
 		r = MetaBackward
@@ -207,17 +305,76 @@ func escapeKey(r rune, reader *bufio.Reader) rune {
 			reader.UnreadRune()
 		}
 	case CharEsc:
-
+	default:
+		if IsPrintable(r) {
+			r = MetaKey(r)
+		}
 	}
 	return r
 }
 
+var keyNames = map[rune]string{
+	CharLineStart: "LineStart",
+	CharBackward:  "Backward",
+	CharInterrupt: "Interrupt",
+	CharDelete:    "Delete",
+	CharLineEnd:   "LineEnd",
+	CharForward:   "Forward",
+	CharBell:      "Bell",
+	CharCtrlH:     "CtrlH",
+	CharTab:       "Tab",
+	CharCtrlJ:     "CtrlJ",
+	CharKill:      "Kill",
+	CharCtrlL:     "CtrlL",
+	CharEnter:     "Enter",
+	CharNext:      "Next",
+	CharPrev:      "Prev",
+	CharBckSearch: "BckSearch",
+	CharFwdSearch: "FwdSearch",
+	CharTranspose: "Transpose",
+	CharCtrlU:     "CtrlU",
+	CharCtrlV:     "CtrlV",
+	CharCtrlW:     "CtrlW",
+	CharCtrlX:     "CtrlX",
+	CharCtrlY:     "CtrlY",
+	CharCtrlZ:     "CtrlZ",
+	CharEsc:       "Esc",
+	CharBackspace: "Backspace",
+	MetaBackward:  "MetaBackward",
+	MetaForward:   "MetaForward",
+	MetaDelete:    "MetaDelete",
+	MetaBackspace: "MetaBackspace",
+	MetaTranspose: "MetaTranspose",
+	CharCtrlSpace: "CtrlSpace",
+
+	CharForwardDelete: "ForwardDelete",
+}
+
+// keyName returns a readable name of the key r as seen by the Operation.
+func keyName(r rune) string {
+	if name, ok := keyNames[r]; ok {
+		return name
+	}
+	if key, ok := IsMetaKey(r); ok {
+		return "Meta" + keyName(key)
+	}
+	if r < 32 {
+		return "Ctrl" + string('@'+r)
+	}
+	return strconv.QuoteRune(r)
+}
+
 func SplitByLine(start, screenWidth int, rs []rune) []string {
+	return splitByLine(start, screenWidth, rs, runes.Width)
+}
+
+// splitByLine is SplitByLine measuring the runes with width.
+func splitByLine(start, screenWidth int, rs []rune, width func(rune) int) []string {
 	var ret []string
 	buf := bytes.NewBuffer(nil)
 	currentWidth := start
 	for _, r := range rs {
-		w := runes.Width(r)
+		w := width(r)
 		currentWidth += w
 		buf.WriteRune(r)
 		if currentWidth >= screenWidth {
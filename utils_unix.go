@@ -44,6 +44,17 @@ func GetScreenWidth() int {
 	return w
 }
 
+// GetScreenHeight returns the number of rows of the terminal, -1 if it's
+// unknown.
+func GetScreenHeight() int {
+	for _, fd := range []int{syscall.Stdout, syscall.Stderr} {
+		if _, rows, err := GetSize(fd); err == nil {
+			return rows
+		}
+	}
+	return -1
+}
+
 // ClearScreen clears the console screen
 func ClearScreen(w io.Writer) (int, error) {
 	return w.Write([]byte("\033[H"))
@@ -53,6 +64,16 @@ func DefaultIsTerminal() bool {
 	return IsTerminal(syscall.Stdin) && (IsTerminal(syscall.Stdout) || IsTerminal(syscall.Stderr))
 }
 
+// isOutputTerminal reports whether w is a terminal, writers other than
+// files (e.g. a buffer or a remote connection) are assumed to be.
+func isOutputTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return true
+	}
+	return IsTerminal(int(f.Fd()))
+}
+
 func GetStdin() int {
 	return syscall.Stdin
 }
@@ -27,6 +27,16 @@ func GetScreenWidth() int {
 	return int(info.dwSize.x)
 }
 
+// GetScreenHeight returns the number of rows of the console window, -1 if
+// it's unknown.
+func GetScreenHeight() int {
+	info, _ := GetConsoleScreenBufferInfo()
+	if info == nil {
+		return -1
+	}
+	return int(info.srWindow.bottom-info.srWindow.top) + 1
+}
+
 // ClearScreen clears the console screen
 func ClearScreen(_ io.Writer) error {
 	return SetConsoleCursorPosition(&_COORD{0, 0})
@@ -36,6 +46,10 @@ func DefaultIsTerminal() bool {
 	return true
 }
 
+func isOutputTerminal(io.Writer) bool {
+	return true
+}
+
 func DefaultOnWidthChanged(func()) {
 
 }
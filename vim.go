@@ -150,6 +150,29 @@ func (o *opVim) HandleVimNormal(r rune, readNext func() rune) (t rune) {
 	return 0
 }
 
+// IsVimInsertMode reports whether the keys are typed in the vim insert
+// mode, where the emacs shortcuts apply.
+func (o *opVim) IsVimInsertMode() bool {
+	return o.IsEnableVimMode() && o.vimMode == VIM_INSERT
+}
+
+// KeyMap binds keys to the keys of the actions they trigger, e.g. Ctrl-O
+// to CharLineStart to move to the line start, or 'H' to '0' in the vim
+// normal mode. A key bound to 0 is ignored.
+type KeyMap map[rune]rune
+
+// keyMap returns the KeyMap of the mode the keys are typed in.
+func (o *opVim) keyMap() KeyMap {
+	cfg := o.op.GetConfig()
+	switch {
+	case !o.IsEnableVimMode():
+		return cfg.EmacsKeyMap
+	case o.vimMode == VIM_INSERT:
+		return cfg.VimInsertKeyMap
+	}
+	return cfg.VimNormalKeyMap
+}
+
 func (o *opVim) EnterVimInsertMode() {
 	o.vimMode = VIM_INSERT
 }